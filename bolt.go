@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"path"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/redis.v4"
+)
+
+// BoltClient keeps everything RedisStore would put in Redis in a single
+// bbolt file, so links and hits survive a restart without a server to run.
+// Every primitive is one bolt transaction, which makes batches and hash
+// transforms atomic the way MULTI/EXEC does.  Writers take turns and each
+// commit is synced to disk before it returns.  Only one process can have
+// the file open at a time, so it is no use for more than one instance.
+//
+// Each kind of redis value has a bucket of its own.  Hashes, sets and
+// sorted sets are a nested bucket per key, sorted set scores being stored
+// as big endian float64 bits.  Keys with a TTL read as missing once it
+// passes and are deleted by the next write to them, and like MemoryClient
+// unique visitors are counted exactly.
+
+type BoltClient struct {
+	db    *bolt.DB
+	clock Clock
+}
+
+var (
+	valuesBucket  = []byte("values")
+	expiresBucket = []byte("expires")
+	hashesBucket  = []byte("hashes")
+	setsBucket    = []byte("sets")
+	zsetsBucket   = []byte("zsets")
+)
+
+// Opens or creates the file, waiting up to a second for another process
+// holding it to let go
+func OpenBoltClient(file string, clock Clock) (*BoltClient, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{valuesBucket, expiresBucket, hashesBucket, setsBucket, zsetsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltClient{db, clock}, nil
+}
+
+func OpenBoltStore(file string) (RedisStore, error) {
+	clock := NewSystemClock()
+	client, err := OpenBoltClient(file, clock)
+	if err != nil {
+		return RedisStore{}, err
+	}
+	return RedisStore{client, clock}, nil
+}
+
+// Whether the value at key has a TTL that has passed
+func (b *BoltClient) expired(tx *bolt.Tx, key string) bool {
+	expiry := tx.Bucket(expiresBucket).Get([]byte(key))
+	if expiry == nil {
+		return false
+	}
+	expiresAt, err := time.Parse(time.RFC3339Nano, string(expiry))
+	return err == nil && !b.clock.UTCNow().Before(expiresAt)
+}
+
+// Drops key if its TTL has passed, must be called in a writable transaction
+func (b *BoltClient) expire(tx *bolt.Tx, key string) error {
+	if !b.expired(tx, key) {
+		return nil
+	}
+	if err := tx.Bucket(valuesBucket).Delete([]byte(key)); err != nil {
+		return err
+	}
+	return tx.Bucket(expiresBucket).Delete([]byte(key))
+}
+
+// Sets or clears the TTL of a value
+func (b *BoltClient) setTTL(tx *bolt.Tx, key string, ttl time.Duration) error {
+	expires := tx.Bucket(expiresBucket)
+	if ttl <= 0 {
+		return expires.Delete([]byte(key))
+	}
+	expiresAt := b.clock.UTCNow().Add(ttl).Format(time.RFC3339Nano)
+	return expires.Put([]byte(key), []byte(expiresAt))
+}
+
+func (b *BoltClient) getKey(key string) (string, error) {
+	var value string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		stored := tx.Bucket(valuesBucket).Get([]byte(key))
+		if stored == nil || b.expired(tx, key) {
+			return redis.Nil
+		}
+		value = string(stored)
+		return nil
+	})
+	return value, err
+}
+
+func (b *BoltClient) setKey(key, value string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(valuesBucket).Put([]byte(key), []byte(value)); err != nil {
+			return err
+		}
+		return b.setTTL(tx, key, 0)
+	})
+}
+
+// Puts value at key if whether it is already there matches exists
+func (b *BoltClient) setKeyIf(exists bool, key, value string, ttl time.Duration) (bool, error) {
+	set := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if err := b.expire(tx, key); err != nil {
+			return err
+		}
+		values := tx.Bucket(valuesBucket)
+		if (values.Get([]byte(key)) != nil) != exists {
+			return nil
+		}
+		if err := values.Put([]byte(key), []byte(value)); err != nil {
+			return err
+		}
+		set = true
+		return b.setTTL(tx, key, ttl)
+	})
+	return set, err
+}
+
+func (b *BoltClient) setKeyIfNotExists(key, value string, ttl time.Duration) (bool, error) {
+	return b.setKeyIf(false, key, value, ttl)
+}
+
+func (b *BoltClient) setKeyIfExists(key, value string, ttl time.Duration) (bool, error) {
+	return b.setKeyIf(true, key, value, ttl)
+}
+
+func (b *BoltClient) deleteKeys(keys ...string) (int64, error) {
+	var deleted int64
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			if err := b.expire(tx, key); err != nil {
+				return err
+			}
+			found := false
+			if values := tx.Bucket(valuesBucket); values.Get([]byte(key)) != nil {
+				found = true
+				if err := values.Delete([]byte(key)); err != nil {
+					return err
+				}
+				if err := b.setTTL(tx, key, 0); err != nil {
+					return err
+				}
+			}
+			for _, name := range [][]byte{hashesBucket, setsBucket, zsetsBucket} {
+				err := tx.Bucket(name).DeleteBucket([]byte(key))
+				if err == nil {
+					found = true
+				} else if err != bolt.ErrBucketNotFound {
+					return err
+				}
+			}
+			if found {
+				deleted++
+			}
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// Every field of the hash at key, empty if there is none
+func readHash(tx *bolt.Tx, key string) map[string]string {
+	hash := make(map[string]string)
+	if bucket := tx.Bucket(hashesBucket).Bucket([]byte(key)); bucket != nil {
+		bucket.ForEach(func(field, value []byte) error {
+			hash[string(field)] = string(value)
+			return nil
+		})
+	}
+	return hash
+}
+
+func (b *BoltClient) getKeyAndField(key, hash, field string) (string, string, error) {
+	var value, fieldValue string
+	present := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(valuesBucket).Get([]byte(key)); v != nil && !b.expired(tx, key) {
+			value, present = string(v), true
+		}
+		if h := tx.Bucket(hashesBucket).Bucket([]byte(hash)); h != nil {
+			fieldValue = string(h.Get([]byte(field)))
+		}
+		return nil
+	})
+	if err == nil && !present {
+		err = redis.Nil
+	}
+	return value, fieldValue, err
+}
+
+func (b *BoltClient) getHash(key string) (map[string]string, error) {
+	var hash map[string]string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		hash = readHash(tx, key)
+		return nil
+	})
+	return hash, err
+}
+
+func (b *BoltClient) hashExists(key string) (bool, error) {
+	exists := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(hashesBucket).Bucket([]byte(key)) != nil
+		return nil
+	})
+	return exists, err
+}
+
+func (b *BoltClient) setHash(key string, fields map[string]string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		hash, err := tx.Bucket(hashesBucket).CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		for field, value := range fields {
+			if err := hash.Put([]byte(field), []byte(value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func incrementHash(tx *bolt.Tx, key string, fields map[string]int64) error {
+	hash, err := tx.Bucket(hashesBucket).CreateBucketIfNotExists([]byte(key))
+	if err != nil {
+		return err
+	}
+	for field, by := range fields {
+		value, _ := strconv.ParseInt(string(hash.Get([]byte(field))), 10, 64)
+		if err := hash.Put([]byte(field), []byte(strconv.FormatInt(value+by, 10))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeScore(score float64) []byte {
+	encoded := make([]byte, 8)
+	binary.BigEndian.PutUint64(encoded, math.Float64bits(score))
+	return encoded
+}
+
+func decodeScore(encoded []byte) float64 {
+	return math.Float64frombits(binary.BigEndian.Uint64(encoded))
+}
+
+// Every member of the sorted set at key with its score, empty if there is
+// none
+func readScores(tx *bolt.Tx, key string) map[string]float64 {
+	scores := make(map[string]float64)
+	if bucket := tx.Bucket(zsetsBucket).Bucket([]byte(key)); bucket != nil {
+		bucket.ForEach(func(member, score []byte) error {
+			scores[string(member)] = decodeScore(score)
+			return nil
+		})
+	}
+	return scores
+}
+
+// Like redis, hashes and sorted sets left empty are removed
+func deleteIfEmpty(parent *bolt.Bucket, key string) error {
+	if bucket := parent.Bucket([]byte(key)); bucket != nil {
+		if first, _ := bucket.Cursor().First(); first == nil {
+			return parent.DeleteBucket([]byte(key))
+		}
+	}
+	return nil
+}
+
+func (b *BoltClient) applyBatch(batch Batch) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for key, fields := range batch.Hashes {
+			if err := incrementHash(tx, key, fields); err != nil {
+				return err
+			}
+		}
+
+		for key, elements := range batch.Uniques {
+			set, err := tx.Bucket(setsBucket).CreateBucketIfNotExists([]byte(key))
+			if err != nil {
+				return err
+			}
+			for _, element := range elements {
+				if err := set.Put([]byte(element), []byte{}); err != nil {
+					return err
+				}
+			}
+		}
+
+		for key, members := range batch.Members {
+			zset, err := tx.Bucket(zsetsBucket).CreateBucketIfNotExists([]byte(key))
+			if err != nil {
+				return err
+			}
+			for member, by := range members {
+				score := by
+				if current := zset.Get([]byte(member)); current != nil {
+					score += decodeScore(current)
+				}
+				if err := zset.Put([]byte(member), encodeScore(score)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Writers take turns, so like MemoryClient there is never a reason to
+// retry.  An error from fn rolls the transaction back.
+func (b *BoltClient) transformHash(key string, fn func(map[string]string) (map[string]int64, []string, error)) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		increments, deletes, err := fn(readHash(tx, key))
+		if err != nil || len(increments)+len(deletes) == 0 {
+			return err
+		}
+
+		if err := incrementHash(tx, key, increments); err != nil {
+			return err
+		}
+		hash := tx.Bucket(hashesBucket).Bucket([]byte(key))
+		for _, field := range deletes {
+			if err := hash.Delete([]byte(field)); err != nil {
+				return err
+			}
+		}
+		return deleteIfEmpty(tx.Bucket(hashesBucket), key)
+	})
+}
+
+// Keys never contain a slash, so path.Match globs like redis does.  The
+// scan only reads, so it never waits on writers, and leaves out expired
+// values rather than deleting them, which is left to the next write to
+// their key.
+func (b *BoltClient) scanKeys(pattern string) ([]string, error) {
+	var keys []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{valuesBucket, hashesBucket, setsBucket, zsetsBucket} {
+			tx.Bucket(name).ForEach(func(key, _ []byte) error {
+				if matched, _ := path.Match(pattern, string(key)); !matched {
+					return nil
+				}
+				if bytes.Equal(name, valuesBucket) && b.expired(tx, string(key)) {
+					return nil
+				}
+				keys = append(keys, string(key))
+				return nil
+			})
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (b *BoltClient) countUnique(keys ...string) ([]int64, error) {
+	counts := make([]int64, len(keys))
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for i, key := range keys {
+			if set := tx.Bucket(setsBucket).Bucket([]byte(key)); set != nil {
+				counts[i] = int64(set.Stats().KeyN)
+			}
+		}
+		return nil
+	})
+	return counts, err
+}
+
+func (b *BoltClient) topMembers(n int64, keys ...string) ([][]Tally, error) {
+	tops := make([][]Tally, len(keys))
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for i, key := range keys {
+			if scores := readScores(tx, key); len(scores) > 0 {
+				tops[i] = firstTallies(rankMembers(scores), n)
+			}
+		}
+		return nil
+	})
+	return tops, err
+}
+
+func (b *BoltClient) trimMembers(key string, keep int64) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		zset := tx.Bucket(zsetsBucket).Bucket([]byte(key))
+		if zset == nil {
+			return nil
+		}
+		for i, tally := range rankMembers(readScores(tx, key)) {
+			if int64(i) >= keep {
+				if err := zset.Delete([]byte(tally.Name)); err != nil {
+					return err
+				}
+			}
+		}
+		return deleteIfEmpty(tx.Bucket(zsetsBucket), key)
+	})
+}
+
+func (b *BoltClient) removeMember(member string, keys ...string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			zset := tx.Bucket(zsetsBucket).Bucket([]byte(key))
+			if zset == nil {
+				continue
+			}
+			if err := zset.Delete([]byte(member)); err != nil {
+				return err
+			}
+			if err := deleteIfEmpty(tx.Bucket(zsetsBucket), key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltClient) unionMembers(n int64, keys ...string) ([]Tally, error) {
+	var union []Tally
+	err := b.db.View(func(tx *bolt.Tx) error {
+		sum := make(map[string]float64)
+		for _, key := range keys {
+			for member, score := range readScores(tx, key) {
+				sum[member] += score
+			}
+		}
+		if len(sum) > 0 {
+			union = firstTallies(rankMembers(sum), n)
+		}
+		return nil
+	})
+	return union, err
+}
+
+func (b *BoltClient) addMembers(key string, members ...string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		zset, err := tx.Bucket(zsetsBucket).CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			if zset.Get([]byte(member)) != nil {
+				continue
+			}
+			if err := zset.Put([]byte(member), encodeScore(0)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Bolt keeps the members of a bucket in byte order already, so this seeks
+// to the first one after rather than reading them all
+func (b *BoltClient) rangeMembers(key, after string, n int64) ([]string, error) {
+	var members []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		zset := tx.Bucket(zsetsBucket).Bucket([]byte(key))
+		if zset == nil {
+			return nil
+		}
+		cursor := zset.Cursor()
+		member, _ := cursor.Seek([]byte(after))
+		if member != nil && string(member) == after {
+			member, _ = cursor.Next()
+		}
+		for ; member != nil && int64(len(members)) < n; member, _ = cursor.Next() {
+			members = append(members, string(member))
+		}
+		return nil
+	})
+	return members, err
+}
+
+func (b *BoltClient) getKeys(keys ...string) (map[string]string, error) {
+	present := make(map[string]string, len(keys))
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			if value := tx.Bucket(valuesBucket).Get([]byte(key)); value != nil && !b.expired(tx, key) {
+				present[key] = string(value)
+			}
+		}
+		return nil
+	})
+	return present, err
+}
+
+func (b *BoltClient) getHashes(keys ...string) ([]map[string]string, error) {
+	hashes := make([]map[string]string, len(keys))
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for i, key := range keys {
+			hashes[i] = readHash(tx, key)
+		}
+		return nil
+	})
+	return hashes, err
+}
+
+// Fails once the file has been closed
+func (b *BoltClient) ping() error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+func (b *BoltClient) close() error {
+	return b.db.Close()
+}
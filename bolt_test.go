@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func testBoltFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "shortener.db"), func() { os.RemoveAll(dir) }
+}
+
+func TestBoltStore(t *testing.T) {
+	var cleanups []func()
+	defer func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+	}()
+
+	testDatastore(t, func(clock *MockClock) Datastore {
+		file, cleanup := testBoltFile(t)
+		client, err := OpenBoltClient(file, clock)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		cleanups = append(cleanups, func() { client.close() }, cleanup)
+		return RedisStore{client, clock}
+	})
+}
+
+func TestBoltStorePersists(t *testing.T) {
+	file, cleanup := testBoltFile(t)
+	defer cleanup()
+
+	clock := &MockClock{current: MockNow}
+	client, _ := OpenBoltClient(file, clock)
+	store := RedisStore{client, clock}
+	store.SaveAlias("baz", "boo.baz", time.Time{})
+	store.SaveAlias("flash", "shop.com/flash", MockNow.Add(time.Hour))
+	store.RecordHits([]Hit{{Code: "baz", Visit: Visit{Visitor: "alice"}, Time: MockNow}})
+
+	// The file is locked while open
+	if _, err := OpenBoltClient(file, clock); err != bolt.ErrTimeout {
+		t.Errorf("Expected: %v\nActual: %v", bolt.ErrTimeout, err)
+	}
+	store.Close()
+
+	clock.current = MockNow.Add(2 * time.Hour)
+	client, err := OpenBoltClient(file, clock)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	store = RedisStore{client, clock}
+	defer store.Close()
+
+	if url, err := store.GetURL("baz"); err != nil || url != "boo.baz" {
+		t.Errorf("Expected: %s\nActual: %s, %v", "boo.baz", url, err)
+	}
+	if hits, _ := store.GetHits("baz"); hits.Count != 1 || hits.Unique != 1 {
+		t.Errorf("Expected %d hit by %d visitor\nActual: %+v", 1, 1, hits)
+	}
+	// TTLs keep running while the file is closed
+	if _, err := store.GetURL("flash"); err != LinkExpired {
+		t.Errorf("Expected: %v\nActual: %v", LinkExpired, err)
+	}
+}
+
+func TestBoltScanKeys(t *testing.T) {
+	file, cleanup := testBoltFile(t)
+	defer cleanup()
+
+	clock := &MockClock{current: MockNow}
+	client, err := OpenBoltClient(file, clock)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer client.close()
+	client.setKey("url:baz", "boo.baz")
+	client.setKeyIfNotExists("url:flash", "shop.com/flash", time.Hour)
+
+	// Scans only read, so a writer holding the file does not hold them up
+	writer, err := client.db.Begin(true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer writer.Rollback()
+
+	clock.current = MockNow.Add(2 * time.Hour)
+	scanned := make(chan []string, 1)
+	go func() {
+		keys, _ := client.scanKeys("url:*")
+		scanned <- keys
+	}()
+
+	select {
+	case keys := <-scanned:
+		// Expired values are left out
+		if len(keys) != 1 || keys[0] != "url:baz" {
+			t.Errorf("Expected: %v\nActual: %v", []string{"url:baz"}, keys)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the scan not to wait for the writer")
+	}
+}
+
+// A Referer longer than bolt's largest key must not fail the batch, taking
+// every other hit in it down too
+func TestBoltLongReferrer(t *testing.T) {
+	file, cleanup := testBoltFile(t)
+	defer cleanup()
+
+	clock := &MockClock{current: MockNow}
+	client, err := OpenBoltClient(file, clock)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	store := RedisStore{client, clock}
+	defer store.Close()
+	store.SaveAlias("baz", "boo.baz", time.Time{})
+
+	good := httptest.NewRequest("GET", "/baz", nil)
+	good.Header.Set("Referer", "https://reddit.com/r/golang")
+	bad := httptest.NewRequest("GET", "/baz", nil)
+	bad.Header.Set("Referer", "https://"+strings.Repeat("a", 40<<10)+".com/")
+	hits := []Hit{
+		{Code: "baz", Visit: newVisit(good, net.ParseIP("10.0.0.1")), Time: MockNow},
+		{Code: "baz", Visit: newVisit(bad, net.ParseIP("10.0.0.2")), Time: MockNow},
+	}
+	if err := store.RecordHits(hits); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if counts, _ := store.GetHits("baz"); counts.Count != 2 {
+		t.Errorf("Expected: %d\nActual: %d", 2, counts.Count)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Link unfurlers, crawlers and link checkers still get redirected, but are
+// counted apart from people so they do not inflate the stats.  Requests are
+// taken for bots when they are HEAD requests, prefetches, or their
+// User-Agent contains one of the patterns, ignoring case.
+
+// Order matters, the first pattern found names the bot, so specific names
+// go before catch-alls like "bot"
+var defaultBotPatterns = []string{
+	"Slackbot",
+	"Twitterbot",
+	"facebookexternalhit",
+	"LinkedInBot",
+	"Discordbot",
+	"TelegramBot",
+	"WhatsApp",
+	"SkypeUriPreview",
+	"Googlebot",
+	"bingbot",
+	"DuckDuckBot",
+	"YandexBot",
+	"Baiduspider",
+	"Applebot",
+	"AhrefsBot",
+	"SemrushBot",
+	"HeadlessChrome",
+	"python-requests",
+	"Go-http-client",
+	"Wget",
+	"bot",
+	"crawler",
+	"spider",
+}
+
+type BotFilter struct {
+	patterns []string
+	// Lower cased patterns, for matching
+	lowered []string
+}
+
+func NewBotFilter(patterns []string) *BotFilter {
+	b := &BotFilter{patterns: patterns}
+	for _, pattern := range patterns {
+		b.lowered = append(b.lowered, strings.ToLower(pattern))
+	}
+	return b
+}
+
+// Reads patterns from file, one per line.  Blank lines and lines starting
+// with # are skipped.
+func LoadBotPatterns(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
+
+// Classify names the bot making r: "HEAD" or "prefetch" for those requests,
+// otherwise the pattern its User-Agent matched.  People get "", as does
+// everyone with a nil BotFilter.
+func (b *BotFilter) Classify(r *http.Request) string {
+	if b == nil {
+		return ""
+	}
+
+	if r.Method == "HEAD" {
+		return "HEAD"
+	}
+
+	if isPrefetch(r) {
+		return "prefetch"
+	}
+
+	userAgent := strings.ToLower(r.UserAgent())
+	for i, pattern := range b.lowered {
+		if strings.Contains(userAgent, pattern) {
+			return b.patterns[i]
+		}
+	}
+	return ""
+}
+
+// Browsers mark speculative requests in a few different ways
+func isPrefetch(r *http.Request) bool {
+	for _, header := range []string{"Purpose", "Sec-Purpose", "X-Purpose", "X-Moz"} {
+		value := strings.ToLower(r.Header.Get(header))
+		if strings.Contains(value, "prefetch") || strings.Contains(value, "preview") {
+			return true
+		}
+	}
+	return false
+}
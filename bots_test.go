@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestClassifyBots(t *testing.T) {
+	expectedMap := map[string]string{
+		"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)": "Slackbot",
+		"Twitterbot/1.0": "Twitterbot",
+		"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)":                                  "facebookexternalhit",
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":                                   "Googlebot",
+		"Mozilla/5.0 (compatible; SomeNewBot/0.1)":                                                                   "bot",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/51.0 Safari/537.36": "",
+		"curl/7.47.0": "",
+		"":            "",
+	}
+
+	bots := NewBotFilter(defaultBotPatterns)
+	for userAgent, expected := range expectedMap {
+		r := httptest.NewRequest("GET", "/blah", nil)
+		r.Header.Set("User-Agent", userAgent)
+		if actual := bots.Classify(r); actual != expected {
+			t.Errorf("User agent: %q\nExpected: %q\nActual: %q", userAgent, expected, actual)
+		}
+	}
+
+	r := httptest.NewRequest("HEAD", "/blah", nil)
+	if actual := bots.Classify(r); actual != "HEAD" {
+		t.Errorf("Expected: %q\nActual: %q", "HEAD", actual)
+	}
+
+	for header, value := range map[string]string{"Purpose": "prefetch", "Sec-Purpose": "prefetch;prerender", "X-Moz": "prefetch", "X-Purpose": "preview"} {
+		r = httptest.NewRequest("GET", "/blah", nil)
+		r.Header.Set(header, value)
+		if actual := bots.Classify(r); actual != "prefetch" {
+			t.Errorf("Header: %s: %s\nExpected: %q\nActual: %q", header, value, "prefetch", actual)
+		}
+	}
+
+	var disabled *BotFilter
+	r = httptest.NewRequest("HEAD", "/blah", nil)
+	if actual := disabled.Classify(r); actual != "" {
+		t.Errorf("Expected nothing taken for a bot\nActual: %q", actual)
+	}
+}
+
+func TestLoadBotPatterns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "bots.txt")
+	ioutil.WriteFile(file, []byte("# Our uptime checker\nPingdom\n\n  StatusCake  \n"), 0644)
+	patterns, err := LoadBotPatterns(file)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if expected := []string{"Pingdom", "StatusCake"}; !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("Expected: %v\nActual: %v", expected, patterns)
+	}
+
+	// Loaded patterns replace the built in ones
+	r := httptest.NewRequest("GET", "/blah", nil)
+	r.Header.Set("User-Agent", "Twitterbot/1.0")
+	if actual := NewBotFilter(patterns).Classify(r); actual != "" {
+		t.Errorf("Expected: %q\nActual: %q", "", actual)
+	}
+
+	r.Header.Set("User-Agent", "Pingdom.com_bot_version_1.4")
+	if actual := NewBotFilter(patterns).Classify(r); actual != "Pingdom" {
+		t.Errorf("Expected: %q\nActual: %q", "Pingdom", actual)
+	}
+
+	if _, err := LoadBotPatterns(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// Redirects are served from Server.UrlCache where possible.  Unknown and
+// expired codes are cached too, for a shorter time, so scanners hammering
+// random paths do not reach Redis either.
+
+// Defaults for Server.CacheTTL and Server.NegativeCacheTTL
+const urlCacheTTL = 5 * time.Minute
+const negativeCacheTTL = 30 * time.Second
+
+type cachedUrl struct {
+	Url string
+	Err error
+}
+
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+func (c *CacheStats) hit() {
+	atomic.AddUint64(&c.Hits, 1)
+}
+
+func (c *CacheStats) miss() {
+	atomic.AddUint64(&c.Misses, 1)
+}
+
+// Snapshot safe to read while requests are being served
+func (c *CacheStats) snapshot() CacheStats {
+	return CacheStats{Hits: atomic.LoadUint64(&c.Hits), Misses: atomic.LoadUint64(&c.Misses)}
+}
+
+// lookupUrl resolves a short url through the cache, falling back to the
+// datastore on a miss.  Only NilValue and LinkExpired are cached, any other
+// error is passed straight through so the next request retries.
+func (s *Server) lookupUrl(short_url string) (string, error) {
+	if entry, found := s.UrlCache.Get(short_url); found {
+		s.CacheStats.hit()
+		cached := entry.(cachedUrl)
+		return cached.Url, cached.Err
+	}
+
+	s.CacheStats.miss()
+	link, err := s.Redis.GetTarget(short_url)
+	switch err {
+	case nil:
+		ttl := s.CacheTTL
+		if link.ExpiresAt != nil {
+			// Never serve a link from the cache past its expiry
+			if remaining := link.ExpiresAt.Sub(s.Clock.UTCNow()); remaining < ttl {
+				ttl = remaining
+			}
+		}
+
+		if ttl > 0 {
+			s.UrlCache.Set(short_url, cachedUrl{Url: link.Url}, ttl)
+		}
+		return link.Url, nil
+	case NilValue, LinkExpired:
+		if s.NegativeCacheTTL > 0 {
+			s.UrlCache.Set(short_url, cachedUrl{Err: err}, s.NegativeCacheTTL)
+		}
+	}
+
+	return "", err
+}
+
+// Must be called whenever a short url is created, retargeted or removed.
+// Other instances are told to evict it too when an Invalidator is set.
+func (s *Server) invalidateUrl(short_url string) {
+	s.UrlCache.Delete(short_url)
+	if s.Invalidator == nil {
+		return
+	}
+
+	if err := s.Invalidator.Publish(short_url); err != nil {
+		log.Printf("Could not publish invalidation of %s: %s", short_url, err.Error())
+	}
+}
+
+// Applies invalidations published by other instances until the Invalidator
+// is closed
+func (s *Server) listenForInvalidations() {
+	s.Invalidator.Listen(s.UrlCache.Delete, s.UrlCache.Flush)
+}
+
+func newUrlCache(ttl time.Duration) *cache.Cache {
+	return cache.New(ttl, 30*time.Second)
+}
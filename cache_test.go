@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func cacheExpiration(server Server, key string) time.Time {
+	return time.Unix(0, server.UrlCache.Items()[key].Expiration)
+}
+
+func TestLookupUrlCached(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+	server := NewServer(mockStore, mockStore.Clock)
+
+	for i := 0; i < 3; i++ {
+		if actual, err := server.lookupUrl("blah"); err != nil || actual != "google.com" {
+			t.Errorf("Expected: %s\nActual: %s (%v)\n", "google.com", actual, err)
+		}
+	}
+
+	// Served from the cache even though redis changed underneath
+	mockClient.values["url:blah"] = "bing.com"
+	if actual, _ := server.lookupUrl("blah"); actual != "google.com" {
+		t.Errorf("Expected cached: %s\nActual: %s\n", "google.com", actual)
+	}
+
+	server.invalidateUrl("blah")
+	if actual, _ := server.lookupUrl("blah"); actual != "bing.com" {
+		t.Errorf("Expected after invalidation: %s\nActual: %s\n", "bing.com", actual)
+	}
+
+	expected := CacheStats{Hits: 3, Misses: 2}
+	if actual := server.CacheStats.snapshot(); actual != expected {
+		t.Errorf("Expected: %+v\nActual: %+v\n", expected, actual)
+	}
+}
+
+func TestLookupUrlNegative(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+	server := NewServer(mockStore, mockStore.Clock)
+
+	if _, err := server.lookupUrl("redsox"); err != NilValue {
+		t.Errorf("Expected: %v\nActual: %v\n", NilValue, err)
+	}
+
+	mockClient.values["url:redsox"] = "mlb.com"
+	if _, err := server.lookupUrl("redsox"); err != NilValue {
+		t.Errorf("Expected cached: %v\nActual: %v\n", NilValue, err)
+	}
+
+	if expiration := cacheExpiration(server, "redsox"); time.Until(expiration) > server.NegativeCacheTTL {
+		t.Errorf("Unknown code cached for longer than %v", server.NegativeCacheTTL)
+	}
+
+	// A zero negative TTL turns the negative cache off
+	server = NewServer(mockStore, mockStore.Clock)
+	server.NegativeCacheTTL = 0
+	delete(mockClient.values, "url:redsox")
+	server.lookupUrl("redsox")
+	if _, found := server.UrlCache.Get("redsox"); found {
+		t.Errorf("Expected unknown code not to be cached")
+	}
+}
+
+func TestLookupUrlExpiring(t *testing.T) {
+	mockStore, _ := CreateMockStore()
+	mockStore.SaveAlias("flash", "shop.com/flash", MockNow.Add(time.Minute))
+	server := NewServer(mockStore, mockStore.Clock)
+
+	server.lookupUrl("flash")
+	if expiration := cacheExpiration(server, "flash"); time.Until(expiration) > time.Minute {
+		t.Errorf("Link expiring in %v cached until %v", time.Minute, expiration)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Behaviour every Datastore has to share, whatever keeps the data.  open
+// returns an empty store reading the time from clock, which the tests move
+// forward to expire links.
+
+func testDatastore(t *testing.T, open func(clock *MockClock) Datastore) {
+	t.Run("Links", func(t *testing.T) {
+		clock := &MockClock{current: MockNow}
+		store := open(clock)
+
+		code, created, err := store.SaveURL("google.com", time.Time{})
+		if err != nil || !created {
+			t.Fatalf("Expected a new link\nActual: %v, %v", created, err)
+		}
+		if again, created, _ := store.SaveURL("google.com", time.Time{}); again != code || created {
+			t.Errorf("Expected: %s, not created\nActual: %s, %v", code, again, created)
+		}
+		if url, err := store.GetURL(code); err != nil || url != "google.com" {
+			t.Errorf("Expected: %s\nActual: %s, %v", "google.com", url, err)
+		}
+		if _, err := store.GetURL("bazang"); err != NilValue {
+			t.Errorf("Expected: %v\nActual: %v", NilValue, err)
+		}
+		if link, err := store.GetTarget(code); err != nil || link.Url != "google.com" || link.ExpiresAt != nil {
+			t.Errorf("Expected: %s, never expiring\nActual: %+v, %v", "google.com", link, err)
+		}
+		if _, err := store.GetTarget("bazang"); err != NilValue {
+			t.Errorf("Expected: %v\nActual: %v", NilValue, err)
+		}
+
+		if created, err := store.SaveAlias("spring", "shop.com/spring", time.Time{}); err != nil || !created {
+			t.Errorf("Expected a new alias\nActual: %v, %v", created, err)
+		}
+		if created, err := store.SaveAlias("spring", "shop.com/spring", time.Time{}); err != nil || created {
+			t.Errorf("Expected the same alias again to be a no-op\nActual: %v, %v", created, err)
+		}
+		if _, err := store.SaveAlias("spring", "shop.com/fall", time.Time{}); err != AliasTaken {
+			t.Errorf("Expected: %v\nActual: %v", AliasTaken, err)
+		}
+
+		if err := store.UpdateURL("spring", "shop.com/spring2"); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+		if err := store.UpdateURL("bazang", "shop.com"); err != NilValue {
+			t.Errorf("Expected: %v\nActual: %v", NilValue, err)
+		}
+
+		expected := Link{Code: "spring", Url: "shop.com/spring2", Created: &MockNow}
+		if link, err := store.GetLink("spring"); err != nil || !reflect.DeepEqual(link, expected) {
+			t.Errorf("Expected: %+v\nActual: %+v, %v", expected, link, err)
+		}
+
+		links, cursor, err := store.ListURLs("", 1)
+		if err != nil || len(links) != 1 || links[0].Code != code || cursor != code {
+			t.Errorf("Expected the first page to hold %s\nActual: %+v, %q, %v", code, links, cursor, err)
+		}
+		links, cursor, _ = store.ListURLs(cursor, 10)
+		if len(links) != 1 || links[0].Code != "spring" || cursor != "" {
+			t.Errorf("Expected the last page to hold %s\nActual: %+v, %q", "spring", links, cursor)
+		}
+
+		if err := store.DeleteURL("spring"); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+		if _, err := store.GetURL("spring"); err != NilValue {
+			t.Errorf("Expected: %v\nActual: %v", NilValue, err)
+		}
+		if err := store.DeleteURL("spring"); err != NilValue {
+			t.Errorf("Expected: %v\nActual: %v", NilValue, err)
+		}
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		clock := &MockClock{current: MockNow}
+		store := open(clock)
+
+		expiresAt := MockNow.Add(time.Hour)
+		if _, err := store.SaveAlias("flash", "shop.com/flash", expiresAt); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if link, _ := store.GetLink("flash"); link.ExpiresAt == nil || !link.ExpiresAt.Equal(expiresAt) {
+			t.Errorf("Expected: %v\nActual: %v", expiresAt, link.ExpiresAt)
+		}
+		if link, _ := store.GetTarget("flash"); link.Url != "shop.com/flash" || link.ExpiresAt == nil || !link.ExpiresAt.Equal(expiresAt) {
+			t.Errorf("Expected: %s, %v\nActual: %+v", "shop.com/flash", expiresAt, link)
+		}
+
+		clock.current = expiresAt
+		if _, err := store.GetURL("flash"); err != LinkExpired {
+			t.Errorf("Expected: %v\nActual: %v", LinkExpired, err)
+		}
+		if _, err := store.GetTarget("flash"); err != LinkExpired {
+			t.Errorf("Expected: %v\nActual: %v", LinkExpired, err)
+		}
+		if err := store.UpdateURL("flash", "shop.com"); err != LinkExpired {
+			t.Errorf("Expected: %v\nActual: %v", LinkExpired, err)
+		}
+
+		// Expired codes stay reserved until deleted
+		if _, err := store.SaveAlias("flash", "example.com", time.Time{}); err != AliasTaken {
+			t.Errorf("Expected: %v\nActual: %v", AliasTaken, err)
+		}
+		if links, _, _ := store.ListURLs("", 10); len(links) != 0 {
+			t.Errorf("Expected no links listed\nActual: %+v", links)
+		}
+		if err := store.DeleteURL("flash"); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+		if _, err := store.SaveAlias("flash", "example.com", time.Time{}); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	})
+
+	t.Run("Hits", func(t *testing.T) {
+		clock := &MockClock{current: MockNow}
+		store := open(clock)
+		store.SaveAlias("baz", "boo.baz", time.Time{})
+		store.SaveAlias("blah", "google.com", time.Time{})
+
+		if _, err := store.GetHits("baz"); err != NilValue {
+			t.Errorf("Expected: %v\nActual: %v", NilValue, err)
+		}
+
+		later := MockNow.Add(25 * time.Hour)
+		err := store.RecordHits([]Hit{
+			{Code: "baz", Visit: Visit{Visitor: "alice", Referrer: "direct", Country: "US"}, Time: MockNow},
+			{Code: "baz", Visit: Visit{Visitor: "bob", Referrer: "direct", Country: "DE"}, Time: MockNow},
+			{Code: "baz", Visit: Visit{Visitor: "alice", Referrer: "twitter.com"}, Time: later},
+			{Code: "baz", Visit: Visit{Visitor: "slack", Bot: "Slackbot"}, Time: later},
+			{Code: "blah", Visit: Visit{Visitor: "alice"}, Time: MockNow},
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		store.IncrementHits("blah", Visit{Visitor: "bob"})
+
+		hits, err := store.GetHits("baz")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		expectedDays := map[time.Time]int{MockNow: 2, MockNow.AddDate(0, 0, 1): 1}
+		if hits.Count != 3 || hits.Unique != 2 || !reflect.DeepEqual(hits.Days, expectedDays) {
+			t.Errorf("Expected %d hits by %d visitors over %v\nActual: %+v", 3, 2, expectedDays, hits)
+		}
+		if expected := []Tally{{"direct", 2}, {"twitter.com", 1}}; !reflect.DeepEqual(hits.Referrers, expected) {
+			t.Errorf("Expected: %v\nActual: %v", expected, hits.Referrers)
+		}
+		if expected := []Tally{{"US", 1}, {"DE", 1}}; !reflect.DeepEqual(hits.Countries, expected) {
+			t.Errorf("Expected: %v\nActual: %v", expected, hits.Countries)
+		}
+		if hits.Bots != 1 || !reflect.DeepEqual(hits.BotAgents, []Tally{{"Slackbot", 1}}) {
+			t.Errorf("Expected %d bot hit\nActual: %+v", 1, hits)
+		}
+
+		if link, _ := store.GetLink("baz"); link.Hits != 3 {
+			t.Errorf("Expected: %d\nActual: %d", 3, link.Hits)
+		}
+
+		expectedTop := []TopLink{{"blah", "google.com", 2}, {"baz", "boo.baz", 2}}
+		if top, err := store.TopLinks(1, 10); err != nil || !reflect.DeepEqual(top, expectedTop) {
+			t.Errorf("Expected: %v\nActual: %v, %v", expectedTop, top, err)
+		}
+
+		// One instance compacts per interval
+		clock.current = MockNow.AddDate(0, 0, 3)
+		if claimed, err := store.ClaimCompaction(time.Hour); err != nil || !claimed {
+			t.Errorf("Expected the compaction lock to be free\nActual: %v, %v", claimed, err)
+		}
+		if claimed, _ := store.ClaimCompaction(time.Hour); claimed {
+			t.Errorf("Expected the compaction lock to be held")
+		}
+		clock.current = clock.current.Add(time.Hour)
+		if claimed, _ := store.ClaimCompaction(time.Hour); !claimed {
+			t.Errorf("Expected the compaction lock to lapse after its interval")
+		}
+
+		// Hours past retention are dropped, their hits stay in the days
+		if _, err := store.CompactHits(RetentionPolicy{Hours: time.Hour}); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+		hits, _ = store.GetHits("baz")
+		if hits.Count != 3 || len(hits.Hours) != 0 || !reflect.DeepEqual(hits.Days, expectedDays) {
+			t.Errorf("Expected %d hits over %v and no hours\nActual: %+v", 3, expectedDays, hits)
+		}
+
+		store.DeleteURL("baz")
+		if _, err := store.GetHits("baz"); err != NilValue {
+			t.Errorf("Expected: %v\nActual: %v", NilValue, err)
+		}
+		expectedTop = []TopLink{{"blah", "google.com", 2}}
+		if top, _ := store.TopLinks(30, 10); !reflect.DeepEqual(top, expectedTop) {
+			t.Errorf("Expected: %v\nActual: %v", expectedTop, top)
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		store := open(&MockClock{current: MockNow})
+		store.SaveAlias("baz", "boo.baz", time.Time{})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					store.RecordHits([]Hit{{Code: "baz", Visit: Visit{Visitor: "alice"}, Time: MockNow}})
+					store.GetHits("baz")
+				}
+			}()
+		}
+		wg.Wait()
+
+		if hits, _ := store.GetHits("baz"); hits.Count != 200 {
+			t.Errorf("Expected: %d\nActual: %d", 200, hits.Count)
+		}
+	})
+
+	t.Run("Health", func(t *testing.T) {
+		store := open(&MockClock{current: MockNow})
+		if err := store.Ping(); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+		if err := store.Close(); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP resolves addresses to a country and city with a local MaxMind DB
+// file, e.g. GeoLite2-Country.mmdb or GeoLite2-City.mmdb, read with
+// maxminddb-golang.  Only the fields Locate needs are decoded from each
+// record.
+type GeoIP struct {
+	reader *maxminddb.Reader
+}
+
+// The parts of a GeoIP2 or GeoLite2 country or city record looked at
+type geoIPRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+// OpenGeoIP maps file into memory, it is kept open for the life of the
+// process
+func OpenGeoIP(file string) (*GeoIP, error) {
+	reader, err := maxminddb.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoIP{reader}, nil
+}
+
+func NewGeoIP(buffer []byte) (*GeoIP, error) {
+	reader, err := maxminddb.FromBytes(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoIP{reader}, nil
+}
+
+// Locate returns the ISO code of the country ip is in and, with a city
+// database, the name of its city as "Berlin, DE".  Both are empty when the
+// address is not found, and a nil GeoIP finds nothing.
+func (g *GeoIP) Locate(ip net.IP) (country string, city string) {
+	if g == nil || ip == nil {
+		return "", ""
+	}
+
+	var record geoIPRecord
+	if err := g.reader.Lookup(ip, &record); err != nil {
+		return "", ""
+	}
+
+	country, city = record.Country.IsoCode, record.City.Names["en"]
+	if city != "" && country != "" {
+		city += ", " + country
+	}
+	return country, city
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// MaxMind's own test databases, from test-data/ of
+// https://github.com/maxmind/MaxMind-DB, see testdata/README.md
+
+func testGeoIP(t *testing.T, file string) *GeoIP {
+	g, err := OpenGeoIP(filepath.Join("testdata", file))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return g
+}
+
+func TestGeoIPLocate(t *testing.T) {
+	expectedMap := map[string][2]string{
+		"81.2.69.142":    {"GB", "London, GB"},
+		"89.160.20.120":  {"SE", "Linköping, SE"},
+		"216.160.83.57":  {"US", "Milton, US"},
+		"67.43.156.1":    {"BT", ""},
+		"1.2.3.4":        {"", ""},
+		"2001:218::1":    {"JP", ""},
+		"2001:480:10::1": {"US", "San Diego, US"},
+		"2001:db8::1":    {"", ""},
+	}
+	g := testGeoIP(t, "GeoIP2-City-Test.mmdb")
+	for address, expected := range expectedMap {
+		country, city := g.Locate(net.ParseIP(address))
+		if actual := [2]string{country, city}; actual != expected {
+			t.Errorf("Address: %s\nExpected: %v\nActual: %v", address, expected, actual)
+		}
+	}
+
+	// Country databases have no cities
+	g = testGeoIP(t, "GeoIP2-Country-Test.mmdb")
+	if country, city := g.Locate(net.ParseIP("81.2.69.142")); country != "GB" || city != "" {
+		t.Errorf("Expected: %s, %q\nActual: %s, %q", "GB", "", country, city)
+	}
+
+	// Without a database nothing is located
+	var disabled *GeoIP
+	if country, city := disabled.Locate(net.ParseIP("1.2.3.4")); country != "" || city != "" {
+		t.Errorf("Expected nothing located\nActual: %s, %s", country, city)
+	}
+}
+
+func TestNewGeoIP(t *testing.T) {
+	buffer, err := ioutil.ReadFile(filepath.Join("testdata", "GeoIP2-Country-Test.mmdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := NewGeoIP(buffer)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if country, _ := g.Locate(net.ParseIP("89.160.20.120")); country != "SE" {
+		t.Errorf("Expected: %s\nActual: %s", "SE", country)
+	}
+
+	if _, err := NewGeoIP([]byte("not a database")); err == nil {
+		t.Errorf("Expected an error for a file that is not a database")
+	}
+}
+
+func TestOpenGeoIP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := OpenGeoIP(filepath.Join(dir, "missing.mmdb")); err == nil {
+		t.Errorf("Expected an error for a missing database")
+	}
+
+	file := filepath.Join(dir, "test.mmdb")
+	ioutil.WriteFile(file, []byte("not a database"), 0644)
+	if _, err := OpenGeoIP(file); err == nil {
+		t.Errorf("Expected an error for a file that is not a database")
+	}
+}
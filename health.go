@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gocraft/web"
+	"gopkg.in/redis.v4"
+)
+
+// /healthz says the process is up and serving, for liveness probes.
+// /readyz also checks every dependency answers in time, for readiness
+// probes, and returns 503 Service Unavailable when one does not so traffic
+// goes to other instances until it recovers.  The store is named after its
+// kind, such as "redis", "bolt" or "postgres".
+
+// Longest /readyz waits on each dependency
+const readyTimeout = 2 * time.Second
+
+var PingTimeout = errors.New("Timed out")
+
+type DependencyStatus struct {
+	// "ok" or "down"
+	Status string
+	Error  string `json:",omitempty"`
+	// Round trip time in milliseconds
+	Latency float64
+	Pool    *redis.PoolStats `json:",omitempty"`
+}
+
+type Readiness struct {
+	// "ok" or "unavailable"
+	Status       string
+	Dependencies map[string]DependencyStatus
+}
+
+func (s *Server) healthz(w web.ResponseWriter, r *web.Request) {
+	jsonBlob, _ := json.Marshal(struct{ Status string }{"ok"})
+	w.Write(jsonBlob)
+}
+
+func (s *Server) readyz(w web.ResponseWriter, r *web.Request) {
+	readiness := Readiness{Status: "ok", Dependencies: map[string]DependencyStatus{
+		s.StoreName: checkDatastore(s.Redis, readyTimeout),
+	}}
+
+	for _, dependency := range readiness.Dependencies {
+		if dependency.Status != "ok" {
+			readiness.Status = "unavailable"
+		}
+	}
+
+	jsonBlob, _ := json.Marshal(readiness)
+	if readiness.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(jsonBlob)
+}
+
+// Pings store, giving up after timeout.  A ping still stuck then is left
+// to finish on its own.
+func checkDatastore(store Datastore, timeout time.Duration) DependencyStatus {
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		result <- store.Ping()
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-time.After(timeout):
+		err = PingTimeout
+	}
+
+	status := DependencyStatus{Status: "ok", Latency: float64(time.Since(start)) / float64(time.Millisecond)}
+	if pooled, ok := store.(PooledStore); ok {
+		status.Pool = pooled.PoolStats()
+	}
+	if err != nil {
+		status.Status, status.Error = "down", err.Error()
+	}
+	return status
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gocraft/web"
+	"gopkg.in/redis.v4"
+)
+
+// Datastore whose ping fails with err, or never answers when hang is set
+type MockPingStore struct {
+	Datastore
+	err  error
+	hang chan bool
+}
+
+func (m MockPingStore) Ping() error {
+	if m.hang != nil {
+		<-m.hang
+	}
+	return m.err
+}
+
+func (m MockPingStore) PoolStats() *redis.PoolStats {
+	return &redis.PoolStats{Requests: 10, Hits: 9, TotalConns: 2, FreeConns: 1}
+}
+
+func TestCheckDatastore(t *testing.T) {
+	mockStore, _ := CreateMockStore()
+	status := checkDatastore(MockPingStore{Datastore: mockStore}, time.Second)
+	if status.Status != "ok" || status.Error != "" || status.Pool.TotalConns != 2 {
+		t.Errorf("Expected redis up with %d connections\nActual: %+v", 2, status)
+	}
+
+	// Without a connection pool there is nothing to report
+	if status = checkDatastore(mockStore, time.Second); status.Status != "ok" || status.Pool != nil {
+		t.Errorf("Expected redis up without pool stats\nActual: %+v", status)
+	}
+
+	status = checkDatastore(MockPingStore{Datastore: mockStore, err: errors.New("connection refused")}, time.Second)
+	if status.Status != "down" || status.Error != "connection refused" {
+		t.Errorf("Expected: %s, %s\nActual: %+v", "down", "connection refused", status)
+	}
+
+	hang := make(chan bool)
+	defer close(hang)
+	status = checkDatastore(MockPingStore{Datastore: mockStore, hang: hang}, 10*time.Millisecond)
+	if status.Status != "down" || status.Error != PingTimeout.Error() {
+		t.Errorf("Expected: %s, %s\nActual: %+v", "down", PingTimeout.Error(), status)
+	}
+}
+
+func TestReadinessEndpoints(t *testing.T) {
+	_, router := NewMockRouter()
+	rw, request := NewRequest("GET", "/healthz", "")
+	router.ServeHTTP(rw, request)
+	checkResponse(t, rw, 200, `{"Status":"ok"}`)
+
+	rw, request = NewRequest("GET", "/readyz", "")
+	router.ServeHTTP(rw, request)
+	checkResponse(t, rw, 200, "")
+
+	// A broken datastore takes the instance out of rotation, but it stays
+	// alive
+	mockStore, _ := CreateMockStore()
+	server := NewServer(MockPingStore{Datastore: mockStore, err: errors.New("connection refused")}, mockStore.Clock)
+	router = web.New(server)
+	setupRoutes(router, server)
+
+	rw, request = NewRequest("GET", "/readyz", "")
+	router.ServeHTTP(rw, request)
+	checkResponse(t, rw, 503, "")
+	expected := `{"Status":"unavailable","Dependencies":{"redis":{"Status":"down","Error":"connection refused","Latency":`
+	if body := rw.Body.String(); len(body) < len(expected) || body[:len(expected)] != expected {
+		t.Errorf("Expected: %s...\nActual: %s", expected, body)
+	}
+
+	rw, request = NewRequest("GET", "/healthz", "")
+	router.ServeHTTP(rw, request)
+	checkResponse(t, rw, 200, `{"Status":"ok"}`)
+
+	// The dependency is named after the configured store
+	server.StoreName = StoreName("postgres://localhost/shortener")
+	router = web.New(server)
+	setupRoutes(router, server)
+	rw, request = NewRequest("GET", "/readyz", "")
+	router.ServeHTTP(rw, request)
+	expected = `{"Status":"unavailable","Dependencies":{"postgres":{"Status":"down"`
+	if body := rw.Body.String(); len(body) < len(expected) || body[:len(expected)] != expected {
+		t.Errorf("Expected: %s...\nActual: %s", expected, body)
+	}
+}
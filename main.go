@@ -1,44 +1,234 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"syscall"
 	"time"
 
 	"github.com/gocraft/web"
 	"github.com/patrickmn/go-cache"
 )
 
-// Derivative router type to enable bulk addition of middleware
-
 func main() {
-	server := createServer()
+	config, err := LoadConfig(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if config.MigrateHits {
+		store := NewRedisStore(config.Redis.Options())
+		migrated, err := store.MigrateHits()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Migrated %d hits hashes", migrated)
+		return
+	}
+
+	if config.IndexLinks {
+		store := NewRedisStore(config.Redis.Options())
+		indexed, err := store.IndexLinks()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Indexed %d links", indexed)
+		return
+	}
+
+	server := createServer(config)
 	router := web.New(server)
 	setupRoutes(router, server)
 	router.Middleware(web.LoggerMiddleware)
 	currentRoot, _ := os.Getwd()
-	router.Middleware(web.StaticMiddleware(path.Join(currentRoot, "public"), web.StaticOption{IndexFile: "index.html"}))
-	log.Fatal(http.ListenAndServe(":8080", router))
+	router.Middleware(web.StaticMiddleware(path.Join(currentRoot, config.StaticDir), web.StaticOption{IndexFile: "index.html"}))
+
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	endpoints := []endpoint{{newHTTPServer(config.Server, router), listener}}
+
+	if config.TLS.Enabled() {
+		certs, err := NewCertReloader(config.TLS.CertFile, config.TLS.KeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go certs.Watch(time.Duration(config.TLS.ReloadInterval), reload, server.stop)
+		endpoints[0].listener = tls.NewListener(listener, certs.TLSConfig())
+
+		if config.TLS.RedirectListen != "" {
+			redirectListener, err := net.Listen("tcp", config.TLS.RedirectListen)
+			if err != nil {
+				log.Fatal(err)
+			}
+			_, httpsPort, _ := net.SplitHostPort(config.Listen)
+			endpoints = append(endpoints, endpoint{newHTTPServer(config.Server, redirectToHTTPS(httpsPort)), redirectListener})
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	if err := serveUntilSignal(endpoints, server, time.Duration(config.Server.ShutdownTimeout), time.Duration(config.Server.FlushTimeout), signals); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
 
 func setupRoutes(router *web.Router, server Server) {
+	router.Middleware(server.measureRequests)
+	router.Middleware(server.strictTransport)
+	router.Get("/metrics", server.metrics)
 	router.Get("/healthcheck", server.healthcheck)
+	router.Get("/healthz", server.healthz)
+	router.Get("/readyz", server.readyz)
 	router.Post("/create", server.addUrl)
 	router.Get("/:path", server.fetchUrl)
 	router.Get("/stats/:path", server.urlStats)
+	router.Get("/api/links", server.listLinks)
+	router.Get("/api/links/:code", server.getLink)
+	router.Patch("/api/links/:code", server.updateLink)
+	router.Delete("/api/links/:code", server.deleteLink)
+	router.Get("/api/top", server.topLinks)
+	router.Get("/api/cache", server.cacheStats)
+	router.Get("/api/recorder", server.recorderStats)
 }
 
 type Server struct {
-	UrlCache *cache.Cache
-	Redis    Datastore
+	UrlCache    *cache.Cache
+	CacheStats  *CacheStats
+	Invalidator Invalidator
+	Redis       Datastore
+	// The kind of store, naming it in /readyz
+	StoreName string
+	Clock     Clock
+	// Optional, visits are not located without a database
+	GeoIP *GeoIP
+	// Proxies whose X-Forwarded-For is believed
+	TrustedProxies []*net.IPNet
+	// Optional, hits are written during the redirect without one
+	Recorder *HitRecorder
+	// Optional, every visit is counted as a person without one
+	Bots    *BotFilter
+	Metrics *Metrics
+	// Optional, created links are returned as absolute urls under it
+	BaseUrl          string
+	CacheTTL         time.Duration
+	NegativeCacheTTL time.Duration
+	// Sent over HTTPS as Strict-Transport-Security, none when 0
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	// Closed by Close to stop background jobs
+	stop chan struct{}
 }
 
-func createServer() Server {
-	redisUrl := os.Getenv("REDIS_URL")
-	redisClient := NewRedisStore(redisUrl)
-	urlCache := cache.New(5*time.Minute, 30*time.Second)
-	server := Server{UrlCache: urlCache, Redis: redisClient}
+func NewServer(store Datastore, clock Clock) Server {
+	return Server{
+		UrlCache:         newUrlCache(urlCacheTTL),
+		CacheStats:       &CacheStats{},
+		Redis:            store,
+		StoreName:        "redis",
+		Clock:            clock,
+		Bots:             NewBotFilter(defaultBotPatterns),
+		Metrics:          NewMetrics(),
+		CacheTTL:         urlCacheTTL,
+		NegativeCacheTTL: negativeCacheTTL,
+		stop:             make(chan struct{}),
+	}
+}
+
+func createServer(config Config) Server {
+	clock := NewSystemClock()
+	metrics := NewMetrics()
+	var redisClient *RedisClient
+	var sqlStore *SQLStore
+	var store Datastore
+	boltFile, isBolt := BoltPath(config.Store)
+	driver, source, isSQL := SQLSource(config.Store)
+	switch {
+	case config.Store == "memory":
+		log.Println("Keeping links and hits in memory, they are lost when the process exits")
+		store = RedisStore{NewMemoryClient(clock), clock}
+	case isBolt:
+		client, err := OpenBoltClient(boltFile, clock)
+		if err != nil {
+			log.Fatalf("Could not open %s: %s", boltFile, err)
+		}
+		store = RedisStore{client, clock}
+	case isSQL:
+		opened, err := OpenSQLStore(driver, source, clock)
+		if err != nil {
+			log.Fatalf("Could not open the %s store: %s", driver, err)
+		}
+		sqlStore = &opened
+		store = opened
+	default:
+		client := NewRedisClient(config.Redis.Options())
+		redisClient = &client
+		store = RedisStore{InstrumentedRedis{client, metrics}, clock}
+	}
+
+	server := NewServer(store, clock)
+	server.StoreName = StoreName(config.Store)
+	server.Metrics = metrics
+	server.BaseUrl = config.BaseUrl
+	if config.TLS.Enabled() {
+		server.HSTSMaxAge = time.Duration(config.TLS.HSTSMaxAge)
+		server.HSTSIncludeSubdomains = config.TLS.HSTSIncludeSubdomains
+	}
+	server.CacheTTL = time.Duration(config.Cache.TTL)
+	server.NegativeCacheTTL = time.Duration(config.Cache.NegativeTTL)
+	server.UrlCache = newUrlCache(server.CacheTTL)
+
+	// Already checked by config.Validate
+	server.TrustedProxies, _ = parseTrustedProxies(config.TrustedProxies)
+
+	if !config.Features.BotFilter {
+		server.Bots = nil
+	} else if config.BotPatterns != "" {
+		patterns, err := LoadBotPatterns(config.BotPatterns)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.Bots = NewBotFilter(patterns)
+	}
+
+	if config.GeoIPDatabase != "" {
+		var err error
+		server.GeoIP, err = OpenGeoIP(config.GeoIPDatabase)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if config.Features.AsyncHits {
+		server.Recorder = NewHitRecorder(server.Redis, config.Hits.Recorder())
+	}
+
+	// Only shared stores have other instances to tell
+	switch {
+	case !config.Features.Invalidation:
+	case redisClient != nil:
+		server.Invalidator = NewRedisInvalidator(redisClient.Client)
+	case sqlStore != nil && driver == "postgres":
+		server.Invalidator = NewPostgresInvalidator(sqlStore.db, source)
+	}
+	if server.Invalidator != nil {
+		go server.listenForInvalidations()
+	}
+
+	if config.Features.Compaction {
+		go compactHitsPeriodically(server.Redis, config.Hits.Retention(), time.Duration(config.Hits.CompactInterval), server.stop)
+	}
 	return server
 }
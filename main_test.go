@@ -2,14 +2,11 @@ package main
 
 import (
 	"github.com/gocraft/web"
-	"github.com/patrickmn/go-cache"
-	"time"
 )
 
 func NewMockServer() Server {
 	mockRedis, _ := CreateMockStore()
-	cache := cache.New(5*time.Minute, 30*time.Second)
-	return Server{cache, mockRedis}
+	return NewServer(mockRedis, mockRedis.Clock)
 }
 
 func NewMockRouter() (Server, *web.Router) {
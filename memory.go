@@ -0,0 +1,422 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v4"
+)
+
+// MemoryClient keeps everything RedisStore would put in Redis in maps
+// instead, so the shortener can run as a single binary with nothing else
+// to set up.  A RedisStore over it behaves like one over Redis, but nothing
+// survives a restart and nothing is shared between instances.  Every
+// primitive holds a lock throughout, which makes batches and hash
+// transforms atomic the way MULTI/EXEC does.  Keys with a TTL are dropped
+// once it passes, when next looked at or when keys are scanned.  Unique
+// visitors are counted exactly rather than estimated, which costs memory
+// in proportion to the visitors.
+
+type MemoryClient struct {
+	clock Clock
+
+	mu      sync.Mutex // protects the maps below
+	values  map[string]string
+	expires map[string]time.Time
+	hashes  map[string]map[string]string
+	sets    map[string]map[string]bool
+	zsets   map[string]map[string]float64
+}
+
+func NewMemoryClient(clock Clock) *MemoryClient {
+	return &MemoryClient{
+		clock:   clock,
+		values:  make(map[string]string),
+		expires: make(map[string]time.Time),
+		hashes:  make(map[string]map[string]string),
+		sets:    make(map[string]map[string]bool),
+		zsets:   make(map[string]map[string]float64),
+	}
+}
+
+func NewMemoryStore() RedisStore {
+	clock := NewSystemClock()
+	return RedisStore{NewMemoryClient(clock), clock}
+}
+
+// Drops key if its TTL has passed, must be called with the lock held
+func (m *MemoryClient) expire(key string) {
+	if expiry, present := m.expires[key]; present && !m.clock.UTCNow().Before(expiry) {
+		delete(m.values, key)
+		delete(m.expires, key)
+	}
+}
+
+// Sets or clears the TTL of a value, must be called with the lock held
+func (m *MemoryClient) setTTL(key string, ttl time.Duration) {
+	delete(m.expires, key)
+	if ttl > 0 {
+		m.expires[key] = m.clock.UTCNow().Add(ttl)
+	}
+}
+
+func (m *MemoryClient) getKey(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(key)
+	value, present := m.values[key]
+	if !present {
+		return "", redis.Nil
+	}
+	return value, nil
+}
+
+func (m *MemoryClient) setKey(key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = value
+	m.setTTL(key, 0)
+	return nil
+}
+
+func (m *MemoryClient) setKeyIfNotExists(key, value string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(key)
+	if _, present := m.values[key]; present {
+		return false, nil
+	}
+	m.values[key] = value
+	m.setTTL(key, ttl)
+	return true, nil
+}
+
+func (m *MemoryClient) setKeyIfExists(key, value string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(key)
+	if _, present := m.values[key]; !present {
+		return false, nil
+	}
+	m.values[key] = value
+	m.setTTL(key, ttl)
+	return true, nil
+}
+
+func (m *MemoryClient) deleteKeys(keys ...string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deleted int64
+	for _, key := range keys {
+		m.expire(key)
+		_, isValue := m.values[key]
+		_, isHash := m.hashes[key]
+		_, isSet := m.sets[key]
+		_, isSortedSet := m.zsets[key]
+		if isValue || isHash || isSet || isSortedSet {
+			deleted++
+		}
+		delete(m.values, key)
+		delete(m.expires, key)
+		delete(m.hashes, key)
+		delete(m.sets, key)
+		delete(m.zsets, key)
+	}
+	return deleted, nil
+}
+
+// Returns a copy, like HGETALL
+func (m *MemoryClient) getKeyAndField(key, hash, field string) (string, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(key)
+	value, present := m.values[key]
+	if !present {
+		return "", m.hashes[hash][field], redis.Nil
+	}
+	return value, m.hashes[hash][field], nil
+}
+
+func (m *MemoryClient) getHash(key string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.copyHash(key), nil
+}
+
+// Must be called with the lock held
+func (m *MemoryClient) copyHash(key string) map[string]string {
+	hash := make(map[string]string, len(m.hashes[key]))
+	for field, value := range m.hashes[key] {
+		hash[field] = value
+	}
+	return hash
+}
+
+func (m *MemoryClient) hashExists(key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.hashes[key]) > 0, nil
+}
+
+func (m *MemoryClient) setHash(key string, fields map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hash := m.hash(key)
+	for field, value := range fields {
+		hash[field] = value
+	}
+	return nil
+}
+
+// The hash at key, created if missing, must be called with the lock held
+func (m *MemoryClient) hash(key string) map[string]string {
+	hash, present := m.hashes[key]
+	if !present {
+		hash = make(map[string]string)
+		m.hashes[key] = hash
+	}
+	return hash
+}
+
+// Must be called with the lock held
+func (m *MemoryClient) incrementHash(key string, fields map[string]int64) {
+	hash := m.hash(key)
+	for field, by := range fields {
+		value, _ := strconv.ParseInt(hash[field], 10, 64)
+		hash[field] = strconv.FormatInt(value+by, 10)
+	}
+}
+
+func (m *MemoryClient) applyBatch(batch Batch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, fields := range batch.Hashes {
+		m.incrementHash(key, fields)
+	}
+
+	for key, elements := range batch.Uniques {
+		if m.sets[key] == nil {
+			m.sets[key] = make(map[string]bool)
+		}
+		for _, element := range elements {
+			m.sets[key][element] = true
+		}
+	}
+
+	for key, members := range batch.Members {
+		if m.zsets[key] == nil {
+			m.zsets[key] = make(map[string]float64)
+		}
+		for member, by := range members {
+			m.zsets[key][member] += by
+		}
+	}
+	return nil
+}
+
+// No one else can change the hash while the lock is held, so unlike over
+// Redis there is never a reason to retry
+func (m *MemoryClient) transformHash(key string, fn func(map[string]string) (map[string]int64, []string, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	increments, deletes, err := fn(m.copyHash(key))
+	if err != nil || len(increments)+len(deletes) == 0 {
+		return err
+	}
+
+	m.incrementHash(key, increments)
+	for _, field := range deletes {
+		delete(m.hashes[key], field)
+	}
+	// Like redis, hashes left empty are removed
+	if len(m.hashes[key]) == 0 {
+		delete(m.hashes, key)
+	}
+	return nil
+}
+
+// Keys never contain a slash, so path.Match globs like redis does.  Expired
+// values are cleared out on the way.
+func (m *MemoryClient) scanKeys(pattern string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.expires {
+		m.expire(key)
+	}
+
+	var keys []string
+	match := func(key string) {
+		if matched, _ := path.Match(pattern, key); matched {
+			keys = append(keys, key)
+		}
+	}
+	for key := range m.values {
+		match(key)
+	}
+	for key := range m.hashes {
+		match(key)
+	}
+	for key := range m.sets {
+		match(key)
+	}
+	for key := range m.zsets {
+		match(key)
+	}
+	return keys, nil
+}
+
+func (m *MemoryClient) countUnique(keys ...string) ([]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make([]int64, len(keys))
+	for i, key := range keys {
+		counts[i] = int64(len(m.sets[key]))
+	}
+	return counts, nil
+}
+
+// Members of a sorted set, highest score first and ties in reverse name
+// order, like ZREVRANGE
+func rankMembers(scores map[string]float64) []Tally {
+	ranked := make([]Tally, 0, len(scores))
+	for member, score := range scores {
+		ranked = append(ranked, Tally{Name: member, Hits: int(score)})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Hits != ranked[j].Hits {
+			return ranked[i].Hits > ranked[j].Hits
+		}
+		return ranked[i].Name > ranked[j].Name
+	})
+	return ranked
+}
+
+func firstTallies(tallies []Tally, n int64) []Tally {
+	if int64(len(tallies)) > n {
+		return tallies[:n]
+	}
+	return tallies
+}
+
+func (m *MemoryClient) topMembers(n int64, keys ...string) ([][]Tally, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tops := make([][]Tally, len(keys))
+	for i, key := range keys {
+		if len(m.zsets[key]) > 0 {
+			tops[i] = firstTallies(rankMembers(m.zsets[key]), n)
+		}
+	}
+	return tops, nil
+}
+
+func (m *MemoryClient) trimMembers(key string, keep int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, tally := range rankMembers(m.zsets[key]) {
+		if int64(i) >= keep {
+			delete(m.zsets[key], tally.Name)
+		}
+	}
+	if len(m.zsets[key]) == 0 {
+		delete(m.zsets, key)
+	}
+	return nil
+}
+
+// Like redis, sorted sets left empty are removed
+func (m *MemoryClient) removeMember(member string, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		delete(m.zsets[key], member)
+		if len(m.zsets[key]) == 0 {
+			delete(m.zsets, key)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryClient) unionMembers(n int64, keys ...string) ([]Tally, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sum := make(map[string]float64)
+	for _, key := range keys {
+		for member, score := range m.zsets[key] {
+			sum[member] += score
+		}
+	}
+	if len(sum) == 0 {
+		return nil, nil
+	}
+	return firstTallies(rankMembers(sum), n), nil
+}
+
+func (m *MemoryClient) addMembers(key string, members ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.zsets[key] == nil {
+		m.zsets[key] = make(map[string]float64)
+	}
+	for _, member := range members {
+		if _, present := m.zsets[key][member]; !present {
+			m.zsets[key][member] = 0
+		}
+	}
+	return nil
+}
+
+func (m *MemoryClient) rangeMembers(key, after string, n int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return membersAfter(m.zsets[key], after, n), nil
+}
+
+// Up to n members after the given one by name, like ZRANGEBYLEX
+func membersAfter(scores map[string]float64, after string, n int64) []string {
+	var members []string
+	for member := range scores {
+		if member > after {
+			members = append(members, member)
+		}
+	}
+	sort.Strings(members)
+	if int64(len(members)) > n {
+		members = members[:n]
+	}
+	return members
+}
+
+func (m *MemoryClient) getKeys(keys ...string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	present := make(map[string]string, len(keys))
+	for _, key := range keys {
+		m.expire(key)
+		if value, ok := m.values[key]; ok {
+			present[key] = value
+		}
+	}
+	return present, nil
+}
+
+func (m *MemoryClient) getHashes(keys ...string) ([]map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hashes := make([]map[string]string, len(keys))
+	for i, key := range keys {
+		hashes[i] = m.copyHash(key)
+	}
+	return hashes, nil
+}
+
+func (m *MemoryClient) ping() error {
+	return nil
+}
+
+func (m *MemoryClient) close() error {
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"gopkg.in/redis.v4"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testDatastore(t, func(clock *MockClock) Datastore {
+		return RedisStore{NewMemoryClient(clock), clock}
+	})
+}
+
+func TestMemoryClientExpiry(t *testing.T) {
+	clock := &MockClock{current: MockNow}
+	client := NewMemoryClient(clock)
+	client.setKeyIfNotExists("url:flash", "shop.com", time.Minute)
+	client.setKeyIfNotExists("url:forever", "shop.com", 0)
+
+	clock.current = MockNow.Add(59 * time.Second)
+	if value, err := client.getKey("url:flash"); err != nil || value != "shop.com" {
+		t.Errorf("Expected: %s\nActual: %s, %v", "shop.com", value, err)
+	}
+
+	// Setting without a TTL clears it, like SET XX
+	client.setKeyIfNotExists("url:other", "shop.com", time.Minute)
+	client.setKeyIfExists("url:other", "shop.com/2", 0)
+
+	clock.current = MockNow.Add(time.Hour)
+	if _, err := client.getKey("url:flash"); err != redis.Nil {
+		t.Errorf("Expected: %v\nActual: %v", redis.Nil, err)
+	}
+	if created, _ := client.setKeyIfNotExists("url:flash", "shop.com/new", 0); !created {
+		t.Errorf("Expected an expired key to be free")
+	}
+
+	keys, _ := client.scanKeys("url:*")
+	sort.Strings(keys)
+	if expected := []string{"url:flash", "url:forever", "url:other"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected: %v\nActual: %v", expected, keys)
+	}
+}
+
+func TestMemoryClientSortedSets(t *testing.T) {
+	client := NewMemoryClient(CreateMockClock())
+	client.applyBatch(Batch{Members: map[string]map[string]float64{
+		"top:a": {"blah": 3, "ghjk": 1, "foobar": 1},
+		"top:b": {"ghjk": 4},
+	}})
+
+	expected := [][]Tally{{{"blah", 3}, {"ghjk", 1}}, {{"ghjk", 4}}, nil}
+	if actual, _ := client.topMembers(2, "top:a", "top:b", "top:c"); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected: %v\nActual: %v", expected, actual)
+	}
+
+	union := []Tally{{"ghjk", 5}, {"blah", 3}}
+	if actual, _ := client.unionMembers(2, "top:a", "top:b"); !reflect.DeepEqual(actual, union) {
+		t.Errorf("Expected: %v\nActual: %v", union, actual)
+	}
+
+	client.trimMembers("top:a", 1)
+	client.removeMember("ghjk", "top:b")
+	keys, _ := client.scanKeys("top:*")
+	if expected := []string{"top:a"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected: %v\nActual: %v", expected, keys)
+	}
+}
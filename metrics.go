@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocraft/web"
+	"gopkg.in/redis.v4"
+)
+
+// Metrics are served on /metrics in the Prometheus text format.  Only the
+// little that is needed is implemented here: counters and histograms with
+// labels, kept in memory and written out sorted so scrapes are stable.
+
+type Metrics struct {
+	Requests        *CounterVec
+	RequestDuration *HistogramVec
+	RedisDuration   *HistogramVec
+	RedisErrors     *CounterVec
+	LinksCreated    *CounterVec
+}
+
+// Seconds, from a quick cache hit to a slow Redis round trip
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Requests:        NewCounterVec("shortener_http_requests_total", "HTTP requests served, by route, method and status code.", "route", "method", "code"),
+		RequestDuration: NewHistogramVec("shortener_http_request_duration_seconds", "Time taken to serve HTTP requests, by route.", latencyBuckets, "route"),
+		RedisDuration:   NewHistogramVec("shortener_redis_duration_seconds", "Time taken by Redis operations, by operation.", latencyBuckets, "operation"),
+		RedisErrors:     NewCounterVec("shortener_redis_errors_total", "Redis operations that failed, by operation.", "operation"),
+		LinksCreated:    NewCounterVec("shortener_links_created_total", "Short links created."),
+	}
+}
+
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	if len(labels) == 0 {
+		// The one series there is always exists, from zero
+		c.values[""] = 0
+	}
+	return c
+}
+
+// Add increments the series with the given label values, one per label
+func (c *CounterVec) Add(by float64, values ...string) {
+	key := labelKey(values)
+	c.mu.Lock()
+	c.values[key] += by
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) write(b *bytes.Buffer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(b, c.name, c.help, "counter")
+	for _, key := range sortedSeries(c.values) {
+		fmt.Fprintf(b, "%s%s %s\n", c.name, formatLabels(c.labels, splitLabelKey(key), "", ""), formatValue(c.values[key]))
+	}
+}
+
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	// Observations in each bucket alone, summed up when written
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	key := labelKey(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	series, present := h.series[key]
+	if !present {
+		series = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		series.counts[i]++
+	}
+	series.count++
+	series.sum += value
+}
+
+// Records the time since start in seconds
+func (h *HistogramVec) Since(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *HistogramVec) write(b *bytes.Buffer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(b, h.name, h.help, "histogram")
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series, values := h.series[key], splitLabelKey(key)
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += series.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", "+Inf"), series.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values, "", ""), formatValue(series.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, formatLabels(h.labels, values, "", ""), series.count)
+	}
+}
+
+// Label values are joined with a byte that cannot appear in them unescaped
+// to key each series
+const labelSeparator = "\xff"
+
+func labelKey(values []string) string {
+	return strings.Join(values, labelSeparator)
+}
+
+func splitLabelKey(key string) []string {
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, labelSeparator)
+}
+
+func sortedSeries(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Formats names and values as {name="value",...}, with an extra pair on the
+// end when extraName is set
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		if i < len(values) {
+			pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writeHeader(b *bytes.Buffer, name, help, kind string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeGauge(b *bytes.Buffer, name, help string, value float64) {
+	writeHeader(b, name, help, "gauge")
+	fmt.Fprintf(b, "%s %s\n", name, formatValue(value))
+}
+
+func writeCounter(b *bytes.Buffer, name, help string, value float64) {
+	writeHeader(b, name, help, "counter")
+	fmt.Fprintf(b, "%s %s\n", name, formatValue(value))
+}
+
+// Routes worth a short name in labels, the rest go by their path
+var routeNames = map[string]string{
+	"/healthcheck": "healthcheck",
+	"/healthz":     "healthz",
+	"/readyz":      "readyz",
+	"/create":      "create",
+	"/:path":       "redirect",
+	"/stats/:path": "stats",
+}
+
+func routeName(r *web.Request) string {
+	if !r.IsRouted() {
+		return "other"
+	}
+	if name, present := routeNames[r.RoutePath()]; present {
+		return name
+	}
+	return r.RoutePath()
+}
+
+// Methods labelled as themselves.  net/http accepts any token as a method,
+// so the rest are labelled "other" to keep clients from adding series.
+var methodNames = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true, "OPTIONS": true,
+}
+
+func methodName(r *web.Request) string {
+	if methodNames[r.Method] {
+		return r.Method
+	}
+	return "other"
+}
+
+// Middleware counting and timing every request by route.  It must be added
+// before any middleware that can answer without calling next, like
+// StaticMiddleware, so those requests are counted too.
+func (s *Server) measureRequests(w web.ResponseWriter, r *web.Request, next web.NextMiddlewareFunc) {
+	start := time.Now()
+	next(w, r)
+
+	route := routeName(r)
+	s.Metrics.RequestDuration.Since(start, route)
+	s.Metrics.Requests.Inc(route, methodName(r), strconv.Itoa(w.StatusCode()))
+}
+
+func (s *Server) metrics(w web.ResponseWriter, r *web.Request) {
+	var b bytes.Buffer
+	s.Metrics.Requests.write(&b)
+	s.Metrics.RequestDuration.write(&b)
+	s.Metrics.RedisDuration.write(&b)
+	s.Metrics.RedisErrors.write(&b)
+	s.Metrics.LinksCreated.write(&b)
+
+	cache := s.CacheStats.snapshot()
+	writeCounter(&b, "shortener_url_cache_hits_total", "Redirects served from the in-memory cache.", float64(cache.Hits))
+	writeCounter(&b, "shortener_url_cache_misses_total", "Redirects that had to look their link up.", float64(cache.Misses))
+	ratio := 0.0
+	if lookups := cache.Hits + cache.Misses; lookups > 0 {
+		ratio = float64(cache.Hits) / float64(lookups)
+	}
+	writeGauge(&b, "shortener_url_cache_hit_ratio", "Share of redirects served from the in-memory cache.", ratio)
+	writeGauge(&b, "shortener_url_cache_entries", "Links and misses held in the in-memory cache.", float64(s.UrlCache.ItemCount()))
+
+	if s.Recorder != nil {
+		stats := s.Recorder.Stats()
+		writeCounter(&b, "shortener_hits_recorded_total", "Hits written to Redis.", float64(stats.Recorded))
+		writeCounter(&b, "shortener_hits_dropped_total", "Hits dropped with the queue full.", float64(stats.Dropped))
+		writeCounter(&b, "shortener_hits_failed_total", "Hits given up on after every retry.", float64(stats.Failed))
+		writeGauge(&b, "shortener_hits_queued", "Hits waiting to be written.", float64(s.Recorder.Queued()))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// InstrumentedRedis times every call to the Redis it wraps and counts the
+// ones that fail.  redis.Nil is an answer rather than a failure.
+type InstrumentedRedis struct {
+	Redis
+	Metrics *Metrics
+}
+
+func (r InstrumentedRedis) observe(operation string, start time.Time, err error) {
+	r.Metrics.RedisDuration.Since(start, operation)
+	if err != nil && err != redis.Nil {
+		r.Metrics.RedisErrors.Inc(operation)
+	}
+}
+
+func (r InstrumentedRedis) getHash(key string) (map[string]string, error) {
+	start := time.Now()
+	hash, err := r.Redis.getHash(key)
+	r.observe("getHash", start, err)
+	return hash, err
+}
+
+func (r InstrumentedRedis) applyBatch(batch Batch) error {
+	start := time.Now()
+	err := r.Redis.applyBatch(batch)
+	r.observe("applyBatch", start, err)
+	return err
+}
+
+func (r InstrumentedRedis) transformHash(key string, fn func(map[string]string) (map[string]int64, []string, error)) error {
+	start := time.Now()
+	err := r.Redis.transformHash(key, fn)
+	r.observe("transformHash", start, err)
+	return err
+}
+
+func (r InstrumentedRedis) hashExists(key string) (bool, error) {
+	start := time.Now()
+	exists, err := r.Redis.hashExists(key)
+	r.observe("hashExists", start, err)
+	return exists, err
+}
+
+func (r InstrumentedRedis) getKeyAndField(key, hash, field string) (string, string, error) {
+	start := time.Now()
+	value, fieldValue, err := r.Redis.getKeyAndField(key, hash, field)
+	r.observe("getKeyAndField", start, err)
+	return value, fieldValue, err
+}
+
+func (r InstrumentedRedis) getKey(key string) (string, error) {
+	start := time.Now()
+	value, err := r.Redis.getKey(key)
+	r.observe("getKey", start, err)
+	return value, err
+}
+
+func (r InstrumentedRedis) setKey(key, value string) error {
+	start := time.Now()
+	err := r.Redis.setKey(key, value)
+	r.observe("setKey", start, err)
+	return err
+}
+
+func (r InstrumentedRedis) setKeyIfNotExists(key, value string, ttl time.Duration) (bool, error) {
+	start := time.Now()
+	set, err := r.Redis.setKeyIfNotExists(key, value, ttl)
+	r.observe("setKeyIfNotExists", start, err)
+	return set, err
+}
+
+func (r InstrumentedRedis) setKeyIfExists(key, value string, ttl time.Duration) (bool, error) {
+	start := time.Now()
+	set, err := r.Redis.setKeyIfExists(key, value, ttl)
+	r.observe("setKeyIfExists", start, err)
+	return set, err
+}
+
+func (r InstrumentedRedis) deleteKeys(keys ...string) (int64, error) {
+	start := time.Now()
+	deleted, err := r.Redis.deleteKeys(keys...)
+	r.observe("deleteKeys", start, err)
+	return deleted, err
+}
+
+func (r InstrumentedRedis) setHash(key string, fields map[string]string) error {
+	start := time.Now()
+	err := r.Redis.setHash(key, fields)
+	r.observe("setHash", start, err)
+	return err
+}
+
+func (r InstrumentedRedis) scanKeys(pattern string) ([]string, error) {
+	start := time.Now()
+	keys, err := r.Redis.scanKeys(pattern)
+	r.observe("scanKeys", start, err)
+	return keys, err
+}
+
+func (r InstrumentedRedis) countUnique(keys ...string) ([]int64, error) {
+	start := time.Now()
+	counts, err := r.Redis.countUnique(keys...)
+	r.observe("countUnique", start, err)
+	return counts, err
+}
+
+func (r InstrumentedRedis) topMembers(n int64, keys ...string) ([][]Tally, error) {
+	start := time.Now()
+	tops, err := r.Redis.topMembers(n, keys...)
+	r.observe("topMembers", start, err)
+	return tops, err
+}
+
+func (r InstrumentedRedis) trimMembers(key string, keep int64) error {
+	start := time.Now()
+	err := r.Redis.trimMembers(key, keep)
+	r.observe("trimMembers", start, err)
+	return err
+}
+
+func (r InstrumentedRedis) removeMember(member string, keys ...string) error {
+	start := time.Now()
+	err := r.Redis.removeMember(member, keys...)
+	r.observe("removeMember", start, err)
+	return err
+}
+
+func (r InstrumentedRedis) unionMembers(n int64, keys ...string) ([]Tally, error) {
+	start := time.Now()
+	tallies, err := r.Redis.unionMembers(n, keys...)
+	r.observe("unionMembers", start, err)
+	return tallies, err
+}
+
+func (r InstrumentedRedis) addMembers(key string, members ...string) error {
+	start := time.Now()
+	err := r.Redis.addMembers(key, members...)
+	r.observe("addMembers", start, err)
+	return err
+}
+
+func (r InstrumentedRedis) rangeMembers(key, after string, n int64) ([]string, error) {
+	start := time.Now()
+	members, err := r.Redis.rangeMembers(key, after, n)
+	r.observe("rangeMembers", start, err)
+	return members, err
+}
+
+func (r InstrumentedRedis) getKeys(keys ...string) (map[string]string, error) {
+	start := time.Now()
+	values, err := r.Redis.getKeys(keys...)
+	r.observe("getKeys", start, err)
+	return values, err
+}
+
+func (r InstrumentedRedis) getHashes(keys ...string) ([]map[string]string, error) {
+	start := time.Now()
+	hashes, err := r.Redis.getHashes(keys...)
+	r.observe("getHashes", start, err)
+	return hashes, err
+}
+
+func (r InstrumentedRedis) poolStats() *redis.PoolStats {
+	if pooled, ok := r.Redis.(pooledClient); ok {
+		return pooled.poolStats()
+	}
+	return nil
+}
+
+func (r InstrumentedRedis) ping() error {
+	start := time.Now()
+	err := r.Redis.ping()
+	r.observe("ping", start, err)
+	return err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCounterVecExposition(t *testing.T) {
+	counter := NewCounterVec("requests_total", "Requests.", "route", "code")
+	counter.Inc("stats", "200")
+	counter.Add(2, "create", "200")
+	counter.Inc("stats", "200")
+	counter.Inc(`say "hi"\`, "404")
+
+	var b bytes.Buffer
+	counter.write(&b)
+	expected := `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{route="create",code="200"} 2
+requests_total{route="say \"hi\"\\",code="404"} 1
+requests_total{route="stats",code="200"} 2
+`
+	if actual := b.String(); actual != expected {
+		t.Errorf("Expected: %s\nActual: %s", expected, actual)
+	}
+
+	// Counters without labels start out at zero
+	b.Reset()
+	NewCounterVec("created_total", "Created.").write(&b)
+	expected = "# HELP created_total Created.\n# TYPE created_total counter\ncreated_total 0\n"
+	if actual := b.String(); actual != expected {
+		t.Errorf("Expected: %s\nActual: %s", expected, actual)
+	}
+}
+
+func TestHistogramVecExposition(t *testing.T) {
+	histogram := NewHistogramVec("duration_seconds", "Durations.", []float64{0.1, 1}, "route")
+	for _, value := range []float64{0.05, 0.1, 0.5, 3} {
+		histogram.Observe(value, "stats")
+	}
+
+	var b bytes.Buffer
+	histogram.write(&b)
+	expected := `# HELP duration_seconds Durations.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{route="stats",le="0.1"} 2
+duration_seconds_bucket{route="stats",le="1"} 3
+duration_seconds_bucket{route="stats",le="+Inf"} 4
+duration_seconds_sum{route="stats"} 3.65
+duration_seconds_count{route="stats"} 4
+`
+	if actual := b.String(); actual != expected {
+		t.Errorf("Expected: %s\nActual: %s", expected, actual)
+	}
+}
+
+// MockClient whose hashes cannot be read
+type BrokenHashClient struct {
+	MockClient
+}
+
+func (r BrokenHashClient) getHash(key string) (map[string]string, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestInstrumentedRedis(t *testing.T) {
+	metrics := NewMetrics()
+	client := InstrumentedRedis{BrokenHashClient{CreateMockClient()}, metrics}
+	store := RedisStore{client, CreateMockClock()}
+	store.GetURL("blah")
+	store.GetHits("blah")
+
+	// A missing key is not a failure
+	client.getKey("url:redsox")
+
+	var b bytes.Buffer
+	metrics.RedisErrors.write(&b)
+	expected := `# HELP shortener_redis_errors_total Redis operations that failed, by operation.
+# TYPE shortener_redis_errors_total counter
+shortener_redis_errors_total{operation="getHash"} 1
+`
+	if actual := b.String(); actual != expected {
+		t.Errorf("Expected: %s\nActual: %s", expected, actual)
+	}
+
+	for _, operation := range []string{"getKey", "getHash", "hashExists"} {
+		if series := metrics.RedisDuration.series[operation]; series == nil || series.count == 0 {
+			t.Errorf("No latency recorded for %s", operation)
+		}
+	}
+}
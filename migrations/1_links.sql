@@ -0,0 +1,8 @@
+-- Links by short code.  Expired links keep their row, and so their code,
+-- until deleted.
+CREATE TABLE links (
+    code VARCHAR(255) PRIMARY KEY,
+    url TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP
+);
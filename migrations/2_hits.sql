@@ -0,0 +1,38 @@
+-- Hits are aggregated rather than logged: one row per link and hour, day
+-- or month, counting visits by people and by bots apart.  Hours are only
+-- kept for people, and compaction drops old hours and folds old days into
+-- their month.
+CREATE TABLE hits (
+    code VARCHAR(255) NOT NULL,
+    period VARCHAR(5) NOT NULL,
+    started_at TIMESTAMP NOT NULL,
+    people BIGINT NOT NULL DEFAULT 0,
+    bots BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (code, period, started_at)
+);
+
+CREATE INDEX hits_by_period ON hits (period, started_at);
+
+-- Hits by referrer, browser, os, device, country, city and, for bots, by
+-- what they were taken for
+CREATE TABLE breakdowns (
+    code VARCHAR(255) NOT NULL,
+    kind VARCHAR(16) NOT NULL,
+    value TEXT NOT NULL,
+    hits BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (code, kind, value)
+);
+
+-- Distinct visitors of each link, for all time and per day
+CREATE TABLE visitors (
+    code VARCHAR(255) NOT NULL,
+    visitor VARCHAR(255) NOT NULL,
+    PRIMARY KEY (code, visitor)
+);
+
+CREATE TABLE daily_visitors (
+    code VARCHAR(255) NOT NULL,
+    day TIMESTAMP NOT NULL,
+    visitor VARCHAR(255) NOT NULL,
+    PRIMARY KEY (code, day, visitor)
+);
@@ -0,0 +1,6 @@
+-- Locks on periodic jobs, so only one instance runs each per interval.  A
+-- lock is free again once it has expired.
+CREATE TABLE locks (
+    name VARCHAR(255) PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL
+);
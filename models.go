@@ -4,22 +4,63 @@ import (
 	"errors"
 	"gopkg.in/redis.v4"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Datastore interface {
 	GetURL(string) (string, error)
-	SaveURL(string) (string, error)
+	SaveURL(string, time.Time) (string, bool, error)
+	SaveAlias(string, string, time.Time) (bool, error)
+	GetLink(string) (Link, error)
+	GetTarget(string) (Link, error)
+	UpdateURL(string, string) error
+	DeleteURL(string) error
+	ListURLs(string, int) ([]Link, string, error)
 	GetHits(string) (Hits, error)
-	IncrementHits(string) error
+	IncrementHits(string, Visit) error
+	RecordHits([]Hit) error
+	CompactHits(RetentionPolicy) (int, error)
+	ClaimCompaction(time.Duration) (bool, error)
+	TopLinks(int, int) ([]TopLink, error)
+	Ping() error
+	Close() error
+}
+
+// Implemented by stores with a connection pool worth reporting on /readyz
+type PooledStore interface {
+	PoolStats() *redis.PoolStats
 }
 
 type Redis interface {
 	getHash(string) (map[string]string, error)
-	incrementHash(string, string) error
+	applyBatch(Batch) error
+	transformHash(string, func(map[string]string) (map[string]int64, []string, error)) error
 	hashExists(string) (bool, error)
 	getKey(string) (string, error)
+	getKeyAndField(string, string, string) (string, string, error)
 	setKey(string, string) error
+	setKeyIfNotExists(string, string, time.Duration) (bool, error)
+	setKeyIfExists(string, string, time.Duration) (bool, error)
+	deleteKeys(...string) (int64, error)
+	setHash(string, map[string]string) error
+	scanKeys(string) ([]string, error)
+	countUnique(...string) ([]int64, error)
+	topMembers(int64, ...string) ([][]Tally, error)
+	trimMembers(string, int64) error
+	removeMember(string, ...string) error
+	unionMembers(int64, ...string) ([]Tally, error)
+	addMembers(string, ...string) error
+	rangeMembers(string, string, int64) ([]string, error)
+	getKeys(...string) (map[string]string, error)
+	getHashes(...string) ([]map[string]string, error)
+	ping() error
+	close() error
+}
+
+// Implemented by Redis clients with a connection pool
+type pooledClient interface {
+	poolStats() *redis.PoolStats
 }
 
 // Direct database access methods, allows for testability of business logic
@@ -28,8 +69,8 @@ type RedisClient struct {
 	*redis.Client
 }
 
-func NewRedisClient(url string) RedisClient {
-	client := redis.NewClient(&redis.Options{Addr: url})
+func NewRedisClient(options *redis.Options) RedisClient {
+	client := redis.NewClient(options)
 	return RedisClient{client}
 }
 
@@ -37,8 +78,92 @@ func (r RedisClient) getHash(key string) (map[string]string, error) {
 	return r.HGetAll(key).Result()
 }
 
-func (r RedisClient) incrementHash(key, field string) error {
-	return r.HIncrBy(key, field, 1).Err()
+// Runs the changes applyBatch encodes in ARGV as records of an operation, an
+// index into KEYS and its arguments.  PFADD elements are unpacked in chunks,
+// as Lua limits how many values unpack can return at once.
+var applyBatchScript = redis.NewScript(`
+local i = 1
+while i <= #ARGV do
+	local op, key = ARGV[i], KEYS[tonumber(ARGV[i + 1])]
+	if op == "hincrby" then
+		redis.call("HINCRBY", key, ARGV[i + 2], ARGV[i + 3])
+		i = i + 4
+	elseif op == "zincrby" then
+		redis.call("ZINCRBY", key, ARGV[i + 3], ARGV[i + 2])
+		i = i + 4
+	else
+		local last = i + 2 + tonumber(ARGV[i + 2])
+		for j = i + 3, last, 1000 do
+			redis.call("PFADD", key, unpack(ARGV, j, math.min(j + 999, last)))
+		end
+		i = last + 1
+	end
+end
+return 1
+`)
+
+// Applies every change in the batch with a single Lua script, so no other
+// client sees it half applied, in one round trip: EVALSHA, or EVAL too the
+// first time a server sees the script.
+func (r RedisClient) applyBatch(batch Batch) error {
+	var keys []string
+	var args []interface{}
+	for key, fields := range batch.Hashes {
+		keys = append(keys, key)
+		for field, by := range fields {
+			args = append(args, "hincrby", len(keys), field, by)
+		}
+	}
+	for key, elements := range batch.Uniques {
+		keys = append(keys, key)
+		args = append(args, "pfadd", len(keys), len(elements))
+		for _, element := range elements {
+			args = append(args, element)
+		}
+	}
+	for key, members := range batch.Members {
+		keys = append(keys, key)
+		for member, by := range members {
+			args = append(args, "zincrby", len(keys), member, by)
+		}
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return applyBatchScript.Run(r.Client, keys, args...).Err()
+}
+
+// Reads key, then applies the increments and field deletions fn returns for
+// it, only if key was not modified in between.  Retries until that holds.
+func (r RedisClient) transformHash(key string, fn func(map[string]string) (map[string]int64, []string, error)) error {
+	for {
+		err := r.Watch(func(tx *redis.Tx) error {
+			hash, err := tx.HGetAll(key).Result()
+			if err != nil {
+				return err
+			}
+
+			increments, deletes, err := fn(hash)
+			if err != nil || len(increments)+len(deletes) == 0 {
+				return err
+			}
+
+			_, err = tx.MultiExec(func() error {
+				for field, by := range increments {
+					tx.HIncrBy(key, field, by)
+				}
+				if len(deletes) > 0 {
+					tx.HDel(key, deletes...)
+				}
+				return nil
+			})
+			return err
+		}, key)
+
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
 }
 
 func (r RedisClient) hashExists(key string) (bool, error) {
@@ -58,48 +183,700 @@ func (r RedisClient) setKey(key, value string) error {
 	return r.Set(key, value, 0).Err()
 }
 
+func (r RedisClient) setKeyIfNotExists(key, value string, ttl time.Duration) (bool, error) {
+	return r.SetNX(key, value, ttl).Result()
+}
+
+func (r RedisClient) setKeyIfExists(key, value string, ttl time.Duration) (bool, error) {
+	return r.SetXX(key, value, ttl).Result()
+}
+
+func (r RedisClient) deleteKeys(keys ...string) (int64, error) {
+	return r.Del(keys...).Result()
+}
+
+func (r RedisClient) setHash(key string, fields map[string]string) error {
+	return r.HMSet(key, fields).Err()
+}
+
+// Every key matching pattern, walked with SCAN so large keyspaces do not
+// block the server the way KEYS would
+func (r RedisClient) scanKeys(pattern string) ([]string, error) {
+	var keys []string
+	iter := r.Scan(0, pattern, 1000).Iterator()
+	for iter.Next() {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// Estimated cardinality of each HyperLogLog separately, in one round trip
+func (r RedisClient) countUnique(keys ...string) ([]int64, error) {
+	cmds := make([]*redis.IntCmd, len(keys))
+	_, err := r.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, key := range keys {
+			cmds[i] = pipe.PFCount(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]int64, len(keys))
+	for i, cmd := range cmds {
+		counts[i] = cmd.Val()
+	}
+	return counts, nil
+}
+
+// The n highest scoring members of each sorted set, in one round trip
+func (r RedisClient) topMembers(n int64, keys ...string) ([][]Tally, error) {
+	cmds := make([]*redis.ZSliceCmd, len(keys))
+	_, err := r.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, key := range keys {
+			cmds[i] = pipe.ZRevRangeWithScores(key, 0, n-1)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tops := make([][]Tally, len(keys))
+	for i, cmd := range cmds {
+		for _, z := range cmd.Val() {
+			tops[i] = append(tops[i], Tally{Name: z.Member.(string), Hits: int(z.Score)})
+		}
+	}
+	return tops, nil
+}
+
+// Drops all but the keep highest scoring members
+func (r RedisClient) trimMembers(key string, keep int64) error {
+	return r.ZRemRangeByRank(key, 0, -keep-1).Err()
+}
+
+// Removes member from each sorted set, in one round trip
+func (r RedisClient) removeMember(member string, keys ...string) error {
+	_, err := r.Pipelined(func(pipe *redis.Pipeline) error {
+		for _, key := range keys {
+			pipe.ZRem(key, member)
+		}
+		return nil
+	})
+	return err
+}
+
+// Adds the sorted sets in KEYS after the first into that scratch key, reads
+// the ARGV[1] + 1 highest scoring members back and deletes it again
+var unionMembersScript = redis.NewScript(`
+redis.call("ZUNIONSTORE", KEYS[1], #KEYS - 1, unpack(KEYS, 2))
+local top = redis.call("ZREVRANGE", KEYS[1], 0, ARGV[1], "WITHSCORES")
+redis.call("DEL", KEYS[1])
+return top
+`)
+
+// The n highest scoring members of the sorted sets added together.  The
+// sum is stored in a scratch key for ZREVRANGE to read, all inside one Lua
+// script so no other client ever sees it.
+func (r RedisClient) unionMembers(n int64, keys ...string) ([]Tally, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	const scratch = "union:scratch"
+	reply, err := unionMembersScript.Run(r.Client, append([]string{scratch}, keys...), n-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	values, _ := reply.([]interface{})
+	var tallies []Tally
+	for i := 0; i+1 < len(values); i += 2 {
+		name, _ := values[i].(string)
+		score, _ := values[i+1].(string)
+		hits, err := strconv.ParseFloat(score, 64)
+		if err != nil {
+			return nil, err
+		}
+		tallies = append(tallies, Tally{Name: name, Hits: int(hits)})
+	}
+	return tallies, nil
+}
+
+// Adds members to the sorted set with a score of 0, leaving the score of
+// those already there alone
+func (r RedisClient) addMembers(key string, members ...string) error {
+	zs := make([]redis.Z, len(members))
+	for i, member := range members {
+		zs[i] = redis.Z{Member: member}
+	}
+	return r.ZAddNX(key, zs...).Err()
+}
+
+// Up to n members of a sorted set whose members all score 0 that come after
+// the given one by name, or from the first with after empty
+func (r RedisClient) rangeMembers(key, after string, n int64) ([]string, error) {
+	min := "-"
+	if after != "" {
+		min = "(" + after
+	}
+	return r.ZRangeByLex(key, redis.ZRangeBy{Min: min, Max: "+", Count: n}).Result()
+}
+
+// The values of those keys that have one, with a single MGET
+func (r RedisClient) getKeys(keys ...string) (map[string]string, error) {
+	values, err := r.MGet(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	present := make(map[string]string, len(keys))
+	for i, value := range values {
+		if value, ok := value.(string); ok {
+			present[keys[i]] = value
+		}
+	}
+	return present, nil
+}
+
+// A key and a field of a hash, in one round trip.  Fails with redis.Nil
+// when the key does not exist, the field is read either way.
+func (r RedisClient) getKeyAndField(key, hash, field string) (string, string, error) {
+	var get *redis.StringCmd
+	var hget *redis.StringCmd
+	_, err := r.Pipelined(func(pipe *redis.Pipeline) error {
+		get = pipe.Get(key)
+		hget = pipe.HGet(hash, field)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return "", "", err
+	}
+	return get.Val(), hget.Val(), get.Err()
+}
+
+// Every field of each hash, in one round trip
+func (r RedisClient) getHashes(keys ...string) ([]map[string]string, error) {
+	cmds := make([]*redis.StringStringMapCmd, len(keys))
+	_, err := r.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, key := range keys {
+			cmds[i] = pipe.HGetAll(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]map[string]string, len(keys))
+	for i, cmd := range cmds {
+		hashes[i] = cmd.Val()
+	}
+	return hashes, nil
+}
+
+func (r RedisClient) ping() error {
+	return r.Ping().Err()
+}
+
+func (r RedisClient) poolStats() *redis.PoolStats {
+	return r.PoolStats()
+}
+
+func (r RedisClient) close() error {
+	return r.Close()
+}
+
 // Business logic methods, this is where the fun starts
 
 var NilValue = errors.New("Nil value returned")
+var HashCollision = errors.New("Could not find a free short url")
+var AliasTaken = errors.New("Alias already in use")
+var LinkExpired = errors.New("Link has expired")
+
+// Number of salted hashes tried before SaveURL gives up on a long url
+const maxHashAttempts = 10
 
 type RedisStore struct {
 	Redis
 	Clock
 }
 
-func NewRedisStore(url string) RedisStore {
-	redisClient := NewRedisClient(url)
+func NewRedisStore(options *redis.Options) RedisStore {
+	redisClient := NewRedisClient(options)
 	clock := NewSystemClock()
 	return RedisStore{redisClient, clock}
 }
 
+// Ping checks Redis can be reached
+func (r RedisStore) Ping() error {
+	return r.ping()
+}
+
+// PoolStats describes the connection pool, nil without one
+func (r RedisStore) PoolStats() *redis.PoolStats {
+	if pooled, ok := r.Redis.(pooledClient); ok {
+		return pooled.poolStats()
+	}
+	return nil
+}
+
+// Close releases the connections, the store cannot be used afterwards
+func (r RedisStore) Close() error {
+	return r.close()
+}
+
+// GetURL returns LinkExpired rather than NilValue for links whose expiry
+// has passed, so callers can tell a dead campaign link from a typo.
 func (r RedisStore) GetURL(short_url string) (string, error) {
 	key := "url:" + short_url
 	value, err := r.getKey(key)
+	if err != redis.Nil {
+		return value, err
+	}
+
+	expiresAt, err := r.getExpiry(short_url)
+	if err != nil {
+		return "", err
+	}
+
+	if !expiresAt.IsZero() && !expiresAt.After(r.UTCNow()) {
+		return "", LinkExpired
+	}
+
+	return "", NilValue
+}
+
+// SaveURL claims the first free short url in the salted hash sequence of
+// long_url.  Keys are only ever written with SETNX, so a colliding url can
+// never overwrite an existing link, and walking the same sequence again
+// returns the code already holding long_url with the same expiry.  A zero
+// expiresAt stores the link forever.  Also reports whether the link was
+// created rather than found.
+func (r RedisStore) SaveURL(long_url string, expiresAt time.Time) (string, bool, error) {
+	for attempt := 0; attempt < maxHashAttempts; attempt++ {
+		short_url := saltedHashUrl(long_url, attempt)
+		created, err := r.claimURL(short_url, long_url, expiresAt)
+		if err != nil {
+			return "", false, err
+		}
+
+		if created {
+			return short_url, true, nil
+		}
+
+		same, err := r.holdsURL(short_url, long_url, expiresAt)
+		if err != nil {
+			return "", false, err
+		}
+
+		if same {
+			return short_url, false, nil
+		}
+	}
+
+	return "", false, HashCollision
+}
+
+// SaveAlias stores long_url under a caller chosen short url.  Saving the same
+// url and expiry under an alias twice is a no-op, reported as not created,
+// anything else already holding the alias results in AliasTaken.
+func (r RedisStore) SaveAlias(alias, long_url string, expiresAt time.Time) (bool, error) {
+	created, err := r.claimURL(alias, long_url, expiresAt)
+	if err != nil || created {
+		return created, err
+	}
+
+	same, err := r.holdsURL(alias, long_url, expiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	if !same {
+		return false, AliasTaken
+	}
+
+	return false, nil
+}
+
+// Links with an expiry keep it in meta:<short_url>, which outlives the TTL on
+// url:<short_url>.  The leftover entry marks the code as used so it is never
+// handed to another url, and lets GetURL report the link as expired.
+func (r RedisStore) claimURL(short_url, long_url string, expiresAt time.Time) (bool, error) {
+	var ttl time.Duration
+	if !expiresAt.IsZero() {
+		ttl = expiresAt.Sub(r.UTCNow())
+		if ttl <= 0 {
+			return false, LinkExpired
+		}
+	}
+
+	previous, err := r.getExpiry(short_url)
+	if err != nil {
+		return false, err
+	}
+
+	if !previous.IsZero() && !previous.After(r.UTCNow()) {
+		return false, nil
+	}
+
+	created, err := r.setKeyIfNotExists("url:"+short_url, long_url, ttl)
+	if err != nil || !created {
+		return created, err
+	}
+
+	meta := map[string]string{"Created": r.UTCNow().Format(time.RFC3339)}
+	if !expiresAt.IsZero() {
+		meta["ExpiresAt"] = expiresAt.UTC().Format(time.RFC3339)
+	}
+	if err := r.setHash("meta:"+short_url, meta); err != nil {
+		return true, err
+	}
+	return true, r.addMembers(linksKey, short_url)
+}
+
+func (r RedisStore) holdsURL(short_url, long_url string, expiresAt time.Time) (bool, error) {
+	existing, err := r.getKey("url:" + short_url)
 	if err == redis.Nil {
-		return "", NilValue
+		return false, nil
 	}
 
-	return value, err
+	if err != nil || existing != long_url {
+		return false, err
+	}
+
+	existingExpiry, err := r.getExpiry(short_url)
+	if err != nil {
+		return false, err
+	}
+
+	return existingExpiry.Equal(expiresAt.Truncate(time.Second)), nil
 }
 
-func (r RedisStore) SaveURL(long_url string) (string, error) {
-	short_url := hashUrl(long_url)
-	key := "url:" + short_url
-	err := r.setKey(key, long_url)
+func metaTime(meta map[string]string, field string) (*time.Time, error) {
+	if meta[field] == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, meta[field])
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Zero time for links that never expire
+func (r RedisStore) getExpiry(short_url string) (time.Time, error) {
+	meta, err := r.getHash("meta:" + short_url)
+	if err != nil || meta["ExpiresAt"] == "" {
+		return time.Time{}, err
+	}
+
+	return time.Parse(time.RFC3339, meta["ExpiresAt"])
+}
+
+//
+// Link -- everything known about a short url, without following it
+//
+
+// Created and ExpiresAt are nil for links saved before they were recorded and
+// for links that never expire respectively
+type Link struct {
+	Code      string
+	Url       string
+	Created   *time.Time `json:",omitempty"`
+	ExpiresAt *time.Time `json:",omitempty"`
+	Hits      int
+}
+
+func (r RedisStore) GetLink(short_url string) (Link, error) {
+	long_url, err := r.GetURL(short_url)
+	if err != nil {
+		return Link{}, err
+	}
+
+	meta, err := r.getHash("meta:" + short_url)
+	if err != nil {
+		return Link{}, err
+	}
+
+	hits, err := r.getHash("hits:" + short_url)
+	if err != nil {
+		return Link{}, err
+	}
+	return newLink(short_url, long_url, meta, hits)
+}
+
+// GetTarget is GetLink for redirects: only the url and expiry, read
+// together in one round trip
+func (r RedisStore) GetTarget(short_url string) (Link, error) {
+	long_url, expires, err := r.getKeyAndField("url:"+short_url, "meta:"+short_url, "ExpiresAt")
+	if err != nil && err != redis.Nil {
+		return Link{}, err
+	}
+
+	expiresAt, parseErr := metaTime(map[string]string{"ExpiresAt": expires}, "ExpiresAt")
+	if parseErr != nil {
+		return Link{}, parseErr
+	}
+
+	if err == redis.Nil {
+		if expiresAt != nil && !expiresAt.After(r.UTCNow()) {
+			return Link{}, LinkExpired
+		}
+		return Link{}, NilValue
+	}
+	return Link{Code: short_url, Url: long_url, ExpiresAt: expiresAt}, nil
+}
+
+// The link to long_url from its meta:<short_url> and hits:<short_url> hashes
+func newLink(short_url, long_url string, meta, hits map[string]string) (Link, error) {
+	link := Link{Code: short_url, Url: long_url}
+	var err error
+	link.Created, err = metaTime(meta, "Created")
+	if err != nil {
+		return Link{}, err
+	}
+
+	link.ExpiresAt, err = metaTime(meta, "ExpiresAt")
+	if err != nil {
+		return Link{}, err
+	}
+
+	if hits["Total"] != "" {
+		link.Hits, err = strconv.Atoi(hits["Total"])
+	}
+	return link, err
+}
+
+// UpdateURL points an existing link at long_url, keeping its code, expiry
+// and hits
+func (r RedisStore) UpdateURL(short_url, long_url string) error {
+	expiresAt, err := r.getExpiry(short_url)
+	if err != nil {
+		return err
+	}
+
+	var ttl time.Duration
+	if !expiresAt.IsZero() {
+		ttl = expiresAt.Sub(r.UTCNow())
+		if ttl <= 0 {
+			return LinkExpired
+		}
+	}
+
+	updated, err := r.setKeyIfExists("url:"+short_url, long_url, ttl)
+	if err != nil {
+		return err
+	}
+
+	if !updated {
+		return NilValue
+	}
+	return nil
+}
+
+// DeleteURL removes a link along with its hits and metadata, freeing the
+// code for reuse.  Expired links can be deleted too.
+func (r RedisStore) DeleteURL(short_url string) error {
+	// The daily keys are named from the hits hash rather than scanned for
+	hits, err := r.getHash("hits:" + short_url)
+	if err != nil {
+		return err
+	}
+	days := dailyKeyDays(hits, r.UTCNow())
+
+	keys := []string{"url:" + short_url, "hits:" + short_url, "meta:" + short_url, "visitors:" + short_url}
+	keys = append(keys, "bothits:"+short_url, "bots:"+short_url)
+	keys = append(keys, breakdownKeys(short_url)...)
+	for _, day := range days {
+		keys = append(keys, "visitors:"+short_url+":"+day)
+	}
+	deleted, err := r.deleteKeys(keys...)
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return NilValue
+	}
+
+	topKeys := make([]string, len(days), len(days)+1)
+	for i, day := range days {
+		topKeys[i] = "top:" + day
+	}
+	return r.removeMember(short_url, append(topKeys, linksKey)...)
+}
+
+// The days a link can have visitors:<short_url>:<day> and top:<day> keys
+// for: the day fields of its hits hash, and the last topRetentionDays as
+// leaderboards outlive days rolled up into their month
+func dailyKeyDays(hits map[string]string, now time.Time) []string {
+	seen := make(map[string]bool)
+	var days []string
+	add := func(day string) {
+		if !seen[day] {
+			seen[day] = true
+			days = append(days, day)
+		}
+	}
+
+	for field := range hits {
+		if _, err := time.Parse(hitsDateFormat, field); err == nil {
+			add(field)
+		}
+	}
+	// A day more than kept, for leaderboards compaction has yet to drop
+	for i := 0; i <= topRetentionDays; i++ {
+		add(now.AddDate(0, 0, -i).Format(hitsDateFormat))
+	}
+	return days
+}
+
+// Every code ever claimed is a member of the sorted set links, all scoring
+// 0 so they are ordered by name, until the link is deleted.  Expired links
+// stay in it like they keep their meta hash.
+const linksKey = "links"
+
+// ListURLs returns up to limit links ordered by code, starting after the code
+// given as cursor, along with the cursor for the next page ("" on the last
+// page).  Pages are read from the links index with ZRANGEBYLEX, so a page
+// costs the same however many links there are, and ordering by code keeps
+// pages stable while links are being added and removed.  Expired links are
+// skipped, reading further into the index to fill the page.
+func (r RedisStore) ListURLs(cursor string, limit int) ([]Link, string, error) {
+	links := make([]Link, 0, limit)
+	for {
+		// One more than needed tells whether there is another page
+		wanted := limit - len(links)
+		codes, err := r.rangeMembers(linksKey, cursor, int64(wanted+1))
+		if err != nil {
+			return nil, "", err
+		}
+
+		more := len(codes) > wanted
+		if more {
+			codes = codes[:wanted]
+		}
+
+		found, err := r.getLinks(codes)
+		if err != nil {
+			return nil, "", err
+		}
+		links = append(links, found...)
+
+		if !more {
+			return links, "", nil
+		}
+		cursor = codes[len(codes)-1]
+		if len(links) == limit {
+			return links, cursor, nil
+		}
 	}
-	return short_url, nil
+}
+
+// The links of codes in order, leaving out those expired or gone.  Urls are
+// read with one MGET and the meta and hits hashes with one pipeline.
+func (r RedisStore) getLinks(codes []string) ([]Link, error) {
+	if len(codes) == 0 {
+		return nil, nil
+	}
+
+	urlKeys := make([]string, len(codes))
+	hashKeys := make([]string, 0, 2*len(codes))
+	for i, code := range codes {
+		urlKeys[i] = "url:" + code
+		hashKeys = append(hashKeys, "meta:"+code, "hits:"+code)
+	}
+
+	urls, err := r.getKeys(urlKeys...)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes, err := r.getHashes(hashKeys...)
+	if err != nil {
+		return nil, err
+	}
+
+	links := make([]Link, 0, len(codes))
+	for i, code := range codes {
+		long_url, present := urls["url:"+code]
+		if !present {
+			continue
+		}
+
+		link, err := newLink(code, long_url, hashes[2*i], hashes[2*i+1])
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// IndexLinks adds every link to the links index, for links saved before
+// there was one, returning how many there are.  Adding a link twice does
+// nothing, so it is safe to run against live traffic.
+func (r RedisStore) IndexLinks() (int, error) {
+	keys, err := r.scanKeys("url:*")
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+
+	codes := make([]string, len(keys))
+	for i, key := range keys {
+		codes[i] = strings.TrimPrefix(key, "url:")
+	}
+	return len(codes), r.addMembers(linksKey, codes...)
 }
 
 //
 // Hits -- stats about an endpoint
 //
 
+// Hours only cover the retention window and Months only what has been
+// rolled up out of Days, see CompactHits.  Unique and UniqueDays are
+// approximate counts of distinct visitors.  The breakdowns list the most
+// common values first.
 type Hits struct {
-	Count int
-	Days  map[time.Time]int
+	Count      int
+	Unique     int `json:",omitempty"`
+	Days       map[time.Time]int
+	UniqueDays map[time.Time]int `json:",omitempty"`
+	Hours      map[time.Time]int `json:",omitempty"`
+	Months     map[time.Time]int `json:",omitempty"`
+	Referrers  []Tally           `json:",omitempty"`
+	Browsers   []Tally           `json:",omitempty"`
+	OS         []Tally           `json:",omitempty"`
+	Devices    []Tally           `json:",omitempty"`
+	Countries  []Tally           `json:",omitempty"`
+	Cities     []Tally           `json:",omitempty"`
+	// Visits by bots, counted apart from everything above
+	Bots      int               `json:",omitempty"`
+	BotDays   map[time.Time]int `json:",omitempty"`
+	BotAgents []Tally           `json:",omitempty"`
+}
+
+type Tally struct {
+	Name string
+	Hits int
+}
+
+// Breakdowns are sorted sets of hits by referrer host, browser, OS, device,
+// country and city.  Only the top breakdownSize are returned, and
+// CompactHits trims referrers and cities, the unbounded ones, to
+// breakdownRetained.
+const breakdownSize = 10
+const breakdownRetained = 100
+
+func breakdownKeys(short_url string) []string {
+	return []string{
+		"referrers:" + short_url, "browsers:" + short_url, "platforms:" + short_url,
+		"devices:" + short_url, "countries:" + short_url, "cities:" + short_url,
+	}
 }
 
 func NewHits() Hits {
@@ -115,7 +892,12 @@ func (r RedisStore) GetHits(short_url string) (Hits, error) {
 		return NewHits(), err
 	}
 
-	if !exists {
+	botsExist, err := r.hashExists("bothits:" + short_url)
+	if err != nil {
+		return NewHits(), err
+	}
+
+	if !exists && !botsExist {
 		return NewHits(), NilValue
 	}
 
@@ -136,8 +918,8 @@ func (r RedisStore) GetHits(short_url string) (Hits, error) {
 	}
 	delete(hits_map, "Total")
 
-	for str_day, str_hits := range hits_map {
-		day, err := strconv.Atoi(str_day)
+	for field, str_hits := range hits_map {
+		date, period, err := parseHitsField(field, r.UTCNow())
 		if err != nil {
 			return NewHits(), err
 		}
@@ -146,25 +928,460 @@ func (r RedisStore) GetHits(short_url string) (Hits, error) {
 			return NewHits(), err
 		}
 
-		year := r.UTCNow().Year()
-		date := time.Date(year, time.January, day, 0, 0, 0, 0, time.UTC)
-		if date.After(r.UTCNow()) {
-			date = date.AddDate(-1, 0, 0)
+		switch period {
+		case "hour":
+			if result.Hours == nil {
+				result.Hours = make(map[time.Time]int)
+			}
+			result.Hours[date] += hits
+		case "month":
+			if result.Months == nil {
+				result.Months = make(map[time.Time]int)
+			}
+			result.Months[date] += hits
+		default:
+			// A hash caught halfway through MigrateHits can hold both
+			// forms of the same day
+			result.Days[date] += hits
 		}
+	}
+
+	err = r.getUnique(short_url, &result)
+	if err != nil {
+		return NewHits(), err
+	}
 
-		result.Days[date] = hits
+	err = r.getBots(short_url, &result)
+	if err != nil {
+		return NewHits(), err
 	}
 
+	tops, err := r.topMembers(breakdownSize, append(breakdownKeys(short_url), "bots:"+short_url)...)
+	if err != nil {
+		return NewHits(), err
+	}
+	result.Referrers, result.Browsers, result.OS, result.Devices = tops[0], tops[1], tops[2], tops[3]
+	result.Countries, result.Cities, result.BotAgents = tops[4], tops[5], tops[6]
+
 	return result, nil
 }
 
-func (r RedisStore) IncrementHits(short_url string) error {
-	key := "hits:" + short_url
-	err := r.incrementHash(key, "Total")
+// Bot visits are counted in bothits:<short_url>, with a Total and a field
+// per day like hits:<short_url>, and by what they were taken for in the
+// sorted set bots:<short_url>.  Days rolled up into months by CompactHits
+// only remain in the total.
+func (r RedisStore) getBots(short_url string, hits *Hits) error {
+	hash, err := r.getHash("bothits:" + short_url)
+	if err != nil {
+		return err
+	}
+
+	for field, value := range hash {
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+
+		if field == "Total" {
+			hits.Bots = count
+			continue
+		}
+
+		date, period, err := parseHitsField(field, r.UTCNow())
+		if err != nil {
+			return err
+		}
+		if period != "day" {
+			continue
+		}
+
+		if hits.BotDays == nil {
+			hits.BotDays = make(map[time.Time]int)
+		}
+		hits.BotDays[date] += count
+	}
+	return nil
+}
+
+// Visitors are counted in HyperLogLogs, visitors:<short_url> for all time
+// and visitors:<short_url>:<day> per day
+func (r RedisStore) getUnique(short_url string, hits *Hits) error {
+	keys := []string{"visitors:" + short_url}
+	days := make([]time.Time, 0, len(hits.Days))
+	for day := range hits.Days {
+		keys = append(keys, "visitors:"+short_url+":"+day.Format(hitsDateFormat))
+		days = append(days, day)
+	}
+
+	counts, err := r.countUnique(keys...)
+	if err != nil {
+		return err
+	}
+
+	hits.Unique = int(counts[0])
+	for i, day := range days {
+		if counts[i+1] == 0 {
+			continue
+		}
+
+		if hits.UniqueDays == nil {
+			hits.UniqueDays = make(map[time.Time]int)
+		}
+		hits.UniqueDays[day] = int(counts[i+1])
+	}
+	return nil
+}
+
+// Hit is a single redirect waiting to be recorded, with the time it
+// happened at so recording it late still counts it in the right hour
+type Hit struct {
+	Code  string
+	Visit Visit
+	Time  time.Time
+}
+
+// Batch collects the increments a run of hits makes, summed per key, so
+// they can go to redis together
+type Batch struct {
+	// Hash field increments, by key
+	Hashes map[string]map[string]int64
+	// Elements to add to HyperLogLogs, by key
+	Uniques map[string][]string
+	// Sorted set member score increments, by key
+	Members map[string]map[string]float64
+}
+
+func NewBatch() Batch {
+	return Batch{
+		Hashes:  make(map[string]map[string]int64),
+		Uniques: make(map[string][]string),
+		Members: make(map[string]map[string]float64),
+	}
+}
+
+func (b Batch) incrementField(key, field string) {
+	if b.Hashes[key] == nil {
+		b.Hashes[key] = make(map[string]int64)
+	}
+	b.Hashes[key][field]++
+}
+
+func (b Batch) incrementMember(key, member string) {
+	if b.Members[key] == nil {
+		b.Members[key] = make(map[string]float64)
+	}
+	b.Members[key][member]++
+}
+
+func (r RedisStore) IncrementHits(short_url string, visit Visit) error {
+	return r.RecordHits([]Hit{{Code: short_url, Visit: visit, Time: r.UTCNow()}})
+}
+
+// RecordHits counts each hit in the hits hash, visitor HyperLogLogs and
+// breakdowns of its link and in the day's leaderboard, or for bots just in
+// the bot counts, all in one transaction
+func (r RedisStore) RecordHits(hits []Hit) error {
+	if len(hits) == 0 {
+		return nil
+	}
+
+	batch := NewBatch()
+	for _, hit := range hits {
+		day := hit.Time.Format(hitsDateFormat)
+		if hit.Visit.Bot != "" {
+			batch.incrementField("bothits:"+hit.Code, "Total")
+			batch.incrementField("bothits:"+hit.Code, day)
+			batch.incrementMember("bots:"+hit.Code, hit.Visit.Bot)
+			continue
+		}
+
+		key := "hits:" + hit.Code
+		batch.incrementMember(topKey(hit.Time), hit.Code)
+		batch.incrementField(key, "Total")
+		batch.incrementField(key, day)
+		batch.incrementField(key, hit.Time.Format(hitsHourFormat))
+
+		for _, key := range []string{"visitors:" + hit.Code, "visitors:" + hit.Code + ":" + day} {
+			batch.Uniques[key] = append(batch.Uniques[key], hit.Visit.Visitor)
+		}
+
+		visit := hit.Visit
+		for i, value := range []string{visit.Referrer, visit.Browser, visit.OS, visit.Device, visit.Country, visit.City} {
+			if value != "" {
+				batch.incrementMember(breakdownKeys(hit.Code)[i], value)
+			}
+		}
+	}
+	return r.applyBatch(batch)
+}
+
+// Each day's hits by people are also tallied per link in the sorted set
+// top:<day>, so links can be ranked over the last few days.  CompactHits
+// drops days older than the longest ranking asked for.
+const topRetentionDays = 30
+
+func topKey(day time.Time) string {
+	return "top:" + day.Format(hitsDateFormat)
+}
+
+type TopLink struct {
+	Code string
+	Url  string
+	Hits int
+}
+
+// TopLinks returns the limit links with the most hits over the last days
+// days, today included.  Links since deleted or expired are left out, so
+// fewer than limit can come back.
+func (r RedisStore) TopLinks(days int, limit int) ([]TopLink, error) {
+	today := r.UTCNow()
+	keys := make([]string, days)
+	for i := range keys {
+		keys[i] = topKey(today.AddDate(0, 0, -i))
+	}
+
+	tallies, err := r.unionMembers(int64(limit), keys...)
+	if err != nil {
+		return nil, err
+	}
+	if len(tallies) == 0 {
+		return []TopLink{}, nil
+	}
+
+	urlKeys := make([]string, len(tallies))
+	for i, tally := range tallies {
+		urlKeys[i] = "url:" + tally.Name
+	}
+	urls, err := r.getKeys(urlKeys...)
+	if err != nil {
+		return nil, err
+	}
+
+	links := make([]TopLink, 0, len(tallies))
+	for _, tally := range tallies {
+		url, ok := urls["url:"+tally.Name]
+		if !ok {
+			continue
+		}
+		links = append(links, TopLink{Code: tally.Name, Url: url, Hits: tally.Hits})
+	}
+	return links, nil
+}
+
+// Besides Total, hits:<short_url> holds a field per day like "2016-09-14",
+// per hour like "2016-09-14T13" and per month like "2016-09" once days have
+// been rolled up.  Older versions keyed days by the day of the year, "258",
+// which cannot tell one year from the next.
+const hitsDateFormat = "2006-01-02"
+const hitsHourFormat = "2006-01-02T15"
+const hitsMonthFormat = "2006-01"
+
+// Start of the period a hits field counts, and whether that period is an
+// "hour", "day" or "month"
+func parseHitsField(field string, now time.Time) (time.Time, string, error) {
+	if date, err := time.Parse(hitsDateFormat, field); err == nil {
+		return date, "day", nil
+	}
+
+	if date, err := time.Parse(hitsHourFormat, field); err == nil {
+		return date, "hour", nil
+	}
+
+	if date, err := time.Parse(hitsMonthFormat, field); err == nil {
+		return date, "month", nil
+	}
+
+	day, err := strconv.Atoi(field)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+
+	// Best guess for a legacy field: the most recent such day up to now
+	date := time.Date(now.Year(), time.January, day, 0, 0, 0, 0, time.UTC)
+	if date.After(now) {
+		date = date.AddDate(-1, 0, 0)
+	}
+	return date, "day", nil
+}
+
+// MigrateHits rewrites day of year fields in every hits hash as calendar
+// dates, returning the number of hashes changed.  Each hash is rewritten in
+// a transaction that is retried if a hit lands meanwhile, so it is safe to
+// run against live traffic and from several instances at once.
+func (r RedisStore) MigrateHits() (int, error) {
+	keys, err := r.scanKeys("hits:*")
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, key := range keys {
+		changed := false
+		err := r.transformHash(key, func(hash map[string]string) (map[string]int64, []string, error) {
+			increments := make(map[string]int64)
+			var legacy []string
+			for field, value := range hash {
+				if _, err := strconv.Atoi(field); err != nil {
+					// Total or already a date
+					continue
+				}
+
+				date, _, err := parseHitsField(field, r.UTCNow())
+				if err != nil {
+					return nil, nil, err
+				}
+
+				hits, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return nil, nil, err
+				}
+
+				increments[date.Format(hitsDateFormat)] += hits
+				legacy = append(legacy, field)
+			}
+
+			changed = len(legacy) > 0
+			return increments, legacy, nil
+		})
+		if err != nil {
+			return migrated, err
+		}
+
+		if changed {
+			migrated++
+		}
+	}
+
+	return migrated, nil
+}
+
+// How long hourly and daily hit counts are kept.  Zero keeps them forever.
+type RetentionPolicy struct {
+	Hours time.Duration
+	Days  time.Duration
+}
+
+// Held by the instance compacting hits, see ClaimCompaction
+const compactionLockKey = "lock:compaction"
+
+// ClaimCompaction takes the compaction lock for interval with SET NX PX,
+// returning false while another instance holds it.  Every instance tries
+// on each tick, and the lock only lapses once an interval has passed, so
+// the keyspace is compacted by one instance per interval however many run.
+func (r RedisStore) ClaimCompaction(interval time.Duration) (bool, error) {
+	return r.setKeyIfNotExists(compactionLockKey, r.UTCNow().Format(time.RFC3339), interval)
+}
+
+// CompactHits drops hour fields older than policy.Hours, whose hits are
+// already counted in their day, and folds day fields older than policy.Days
+// into their month, for people and bots alike.  Daily visitor counts past
+// policy.Days are dropped, as HyperLogLogs of different days cannot be added
+// up, as are leaderboards older than topRetentionDays, and referrer and city
+// breakdowns are trimmed.  Returns the number of hashes changed.
+func (r RedisStore) CompactHits(policy RetentionPolicy) (int, error) {
+	keys, err := r.scanKeys("hits:*")
+	if err != nil {
+		return 0, err
+	}
+
+	botKeys, err := r.scanKeys("bothits:*")
+	if err != nil {
+		return 0, err
+	}
+	keys = append(keys, botKeys...)
+
+	now := r.UTCNow()
+	compacted := 0
+	for _, key := range keys {
+		changed := false
+		err := r.transformHash(key, func(hash map[string]string) (map[string]int64, []string, error) {
+			increments := make(map[string]int64)
+			var expired []string
+			hourCutoff, dayCutoff := now.Add(-policy.Hours), now.Add(-policy.Days)
+			for field, value := range hash {
+				if field == "Total" {
+					continue
+				}
+
+				date, period, err := parseHitsField(field, now)
+				if err != nil {
+					return nil, nil, err
+				}
+
+				switch {
+				// Only periods that ended before the cutoff are touched
+				case period == "hour" && policy.Hours > 0 && !date.Add(time.Hour).After(hourCutoff):
+					expired = append(expired, field)
+				case period == "day" && policy.Days > 0 && !date.AddDate(0, 0, 1).After(dayCutoff):
+					hits, err := strconv.ParseInt(value, 10, 64)
+					if err != nil {
+						return nil, nil, err
+					}
+					increments[date.Format(hitsMonthFormat)] += hits
+					expired = append(expired, field)
+				}
+			}
+
+			changed = len(expired) > 0
+			return increments, expired, nil
+		})
+		if err != nil {
+			return compacted, err
+		}
+
+		if changed {
+			compacted++
+		}
+	}
+
+	referrers, err := r.scanKeys("referrers:*")
+	if err != nil {
+		return compacted, err
+	}
+
+	cities, err := r.scanKeys("cities:*")
+	if err != nil {
+		return compacted, err
+	}
+
+	for _, key := range append(referrers, cities...) {
+		err = r.trimMembers(key, breakdownRetained)
+		if err != nil {
+			return compacted, err
+		}
+	}
+
+	if policy.Days > 0 {
+		err = r.dropDailyKeys("visitors:*:*", now.Add(-policy.Days))
+		if err != nil {
+			return compacted, err
+		}
+	}
+
+	err = r.dropDailyKeys("top:*", now.AddDate(0, 0, -topRetentionDays))
+	return compacted, err
+}
+
+// Deletes the keys matching pattern that end in a day, like
+// visitors:<short_url>:<day>, if the day is over by cutoff
+func (r RedisStore) dropDailyKeys(pattern string, cutoff time.Time) error {
+	keys, err := r.scanKeys(pattern)
 	if err != nil {
 		return err
 	}
 
-	days := r.UTCNow().YearDay()
-	return r.incrementHash(key, strconv.Itoa(days))
+	var expired []string
+	for _, key := range keys {
+		day, err := time.Parse(hitsDateFormat, key[strings.LastIndex(key, ":")+1:])
+		if err == nil && !day.AddDate(0, 0, 1).After(cutoff) {
+			expired = append(expired, key)
+		}
+	}
+
+	if len(expired) == 0 {
+		return nil
+	}
+
+	_, err = r.deleteKeys(expired...)
+	return err
 }
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"gopkg.in/redis.v4"
+	"io"
+	"net"
+	"path"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -13,6 +20,18 @@ import (
 type MockClient struct {
 	values map[string]string
 	hashes map[string]map[string]string
+	ttls   map[string]time.Duration
+	// Field increments of each applyBatch call, by key
+	increments map[string][]map[string]int64
+	// HyperLogLogs, counted exactly
+	sets map[string]map[string]bool
+	// Sorted sets, member to score
+	zsets map[string]map[string]float64
+
+	// Keys with a TTL only expire by clock if one is set
+	clock   Clock
+	expires map[string]time.Time
+	mu      *sync.Mutex
 }
 
 func CreateMockStore() (RedisStore, MockClient) {
@@ -21,16 +40,62 @@ func CreateMockStore() (RedisStore, MockClient) {
 	return RedisStore{client, clock}, client
 }
 
+// An empty client, with a clock keys with a TTL expire like on redis
+func NewMockClient(clock Clock) MockClient {
+	return MockClient{
+		values:     make(map[string]string),
+		hashes:     make(map[string]map[string]string),
+		ttls:       make(map[string]time.Duration),
+		increments: make(map[string][]map[string]int64),
+		sets:       make(map[string]map[string]bool),
+		zsets:      make(map[string]map[string]float64),
+		clock:      clock,
+		expires:    make(map[string]time.Time),
+		mu:         new(sync.Mutex),
+	}
+}
+
+func (r MockClient) lock() func() {
+	if r.mu == nil {
+		return func() {}
+	}
+	r.mu.Lock()
+	return r.mu.Unlock
+}
+
+// Drops key if its TTL has run out by the clock
+func (r MockClient) expire(key string) {
+	if expiry, present := r.expires[key]; present && !r.clock.UTCNow().Before(expiry) {
+		r.expireKey(key)
+	}
+}
+
+func (r MockClient) setTTL(key string, ttl time.Duration) {
+	delete(r.ttls, key)
+	delete(r.expires, key)
+	if ttl > 0 {
+		r.ttls[key] = ttl
+		if r.clock != nil {
+			r.expires[key] = r.clock.UTCNow().Add(ttl)
+		}
+	}
+}
+
 func CreateMockClient() MockClient {
 	valuesMap := map[string]string{"url:blah": "google.com", "url:ghjk": "lmgtfy.com", "url:foobar": "boo.baz"}
 	hashesMap := make(map[string]map[string]string)
 	hashesMap["hits:blah"] = map[string]string{"Total": "1117", "1": "78", "168": "34", "296": "672"}
 	hashesMap["hits:ghjk"] = map[string]string{"Total": "387", "3": "31", "204": "14", "308": "76"}
 	hashesMap["hits:foobar"] = map[string]string{"Total": "7", "86": "4", "287": "1", "365": "2"}
-	return MockClient{values: valuesMap, hashes: hashesMap}
+	client := NewMockClient(nil)
+	client.values, client.hashes = valuesMap, hashesMap
+	client.zsets[linksKey] = map[string]float64{"blah": 0, "ghjk": 0, "foobar": 0}
+	return client
 }
 
 func (r MockClient) getKey(key string) (string, error) {
+	defer r.lock()()
+	r.expire(key)
 	value, present := r.values[key]
 	if !present {
 		return "", redis.Nil
@@ -39,48 +104,328 @@ func (r MockClient) getKey(key string) (string, error) {
 	return value, nil
 }
 
+func (r MockClient) getKeyAndField(key, hash, field string) (string, string, error) {
+	defer r.lock()()
+	r.expire(key)
+	value, present := r.values[key]
+	if !present {
+		return "", r.hashes[hash][field], redis.Nil
+	}
+	return value, r.hashes[hash][field], nil
+}
+
 func (r MockClient) setKey(key, value string) error {
+	defer r.lock()()
 	r.values[key] = value
 	return nil
 }
 
-func (r MockClient) getHash(key string) (map[string]string, error) {
-	value, present := r.hashes[key]
+func (r MockClient) setKeyIfNotExists(key, value string, ttl time.Duration) (bool, error) {
+	defer r.lock()()
+	r.expire(key)
+	if _, present := r.values[key]; present {
+		return false, nil
+	}
+
+	r.values[key] = value
+	r.setTTL(key, ttl)
+	return true, nil
+}
+
+func (r MockClient) setKeyIfExists(key, value string, ttl time.Duration) (bool, error) {
+	defer r.lock()()
+	r.expire(key)
+	if _, present := r.values[key]; !present {
+		return false, nil
+	}
+
+	r.values[key] = value
+	r.setTTL(key, ttl)
+	return true, nil
+}
+
+func (r MockClient) deleteKeys(keys ...string) (int64, error) {
+	defer r.lock()()
+	var deleted int64
+	for _, key := range keys {
+		_, isValue := r.values[key]
+		_, isHash := r.hashes[key]
+		_, isSet := r.sets[key]
+		_, isSortedSet := r.zsets[key]
+		if isValue || isHash || isSet || isSortedSet {
+			deleted++
+		}
+		delete(r.values, key)
+		delete(r.hashes, key)
+		delete(r.sets, key)
+		delete(r.zsets, key)
+		delete(r.ttls, key)
+		delete(r.expires, key)
+	}
+	return deleted, nil
+}
+
+func (r MockClient) transformHash(key string, fn func(map[string]string) (map[string]int64, []string, error)) error {
+	defer r.lock()()
+	hash, present := r.hashes[key]
 	if !present {
-		return make(map[string]string), nil
+		hash = make(map[string]string)
+		r.hashes[key] = hash
 	}
 
-	return value, nil
+	increments, deletes, err := fn(hash)
+	if err != nil {
+		return err
+	}
+
+	for field, by := range increments {
+		value, _ := strconv.ParseInt(hash[field], 10, 64)
+		hash[field] = strconv.FormatInt(value+by, 10)
+	}
+	for _, field := range deletes {
+		delete(hash, field)
+	}
+	return nil
 }
 
-func (r MockClient) hashExists(key string) (bool, error) {
-	_, present := r.hashes[key]
+// Keys never contain a slash, so path.Match globs like redis does
+func (r MockClient) scanKeys(pattern string) ([]string, error) {
+	defer r.lock()()
+	for key := range r.expires {
+		r.expire(key)
+	}
+	var keys []string
+	for key := range r.values {
+		if matched, _ := path.Match(pattern, key); matched {
+			keys = append(keys, key)
+		}
+	}
+	for key := range r.hashes {
+		if matched, _ := path.Match(pattern, key); matched {
+			keys = append(keys, key)
+		}
+	}
+	for key := range r.sets {
+		if matched, _ := path.Match(pattern, key); matched {
+			keys = append(keys, key)
+		}
+	}
+	for key := range r.zsets {
+		if matched, _ := path.Match(pattern, key); matched {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Members of a sorted set, highest score first and ties in reverse name
+// order, like ZREVRANGE
+func (r MockClient) rankedMembers(key string) []Tally {
+	var ranked []Tally
+	for member, score := range r.zsets[key] {
+		ranked = append(ranked, Tally{Name: member, Hits: int(score)})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Hits != ranked[j].Hits {
+			return ranked[i].Hits > ranked[j].Hits
+		}
+		return ranked[i].Name > ranked[j].Name
+	})
+	return ranked
+}
+
+// Like redis, sorted sets left empty are removed
+func (r MockClient) removeMember(member string, keys ...string) error {
+	defer r.lock()()
+	for _, key := range keys {
+		delete(r.zsets[key], member)
+		if len(r.zsets[key]) == 0 {
+			delete(r.zsets, key)
+		}
+	}
+	return nil
+}
+
+func (r MockClient) unionMembers(n int64, keys ...string) ([]Tally, error) {
+	defer r.lock()()
+	sum := make(map[string]float64)
+	for _, key := range keys {
+		for member, score := range r.zsets[key] {
+			sum[member] += score
+		}
+	}
+
+	// Ranked like any other sorted set
+	scratch := MockClient{zsets: map[string]map[string]float64{"union": sum}}
+	tops, err := scratch.topMembers(n, "union")
+	return tops[0], err
+}
+
+func (r MockClient) topMembers(n int64, keys ...string) ([][]Tally, error) {
+	defer r.lock()()
+	tops := make([][]Tally, len(keys))
+	for i, key := range keys {
+		tops[i] = r.rankedMembers(key)
+		if int64(len(tops[i])) > n {
+			tops[i] = tops[i][:n]
+		}
+	}
+	return tops, nil
+}
+
+func (r MockClient) trimMembers(key string, keep int64) error {
+	defer r.lock()()
+	for i, tally := range r.rankedMembers(key) {
+		if int64(i) >= keep {
+			delete(r.zsets[key], tally.Name)
+		}
+	}
+	return nil
+}
+
+func (r MockClient) addMembers(key string, members ...string) error {
+	defer r.lock()()
+	if r.zsets[key] == nil {
+		r.zsets[key] = make(map[string]float64)
+	}
+	for _, member := range members {
+		if _, present := r.zsets[key][member]; !present {
+			r.zsets[key][member] = 0
+		}
+	}
+	return nil
+}
+
+func (r MockClient) rangeMembers(key, after string, n int64) ([]string, error) {
+	defer r.lock()()
+	return membersAfter(r.zsets[key], after, n), nil
+}
+
+func (r MockClient) getKeys(keys ...string) (map[string]string, error) {
+	defer r.lock()()
+	present := make(map[string]string)
+	for _, key := range keys {
+		r.expire(key)
+		if value, ok := r.values[key]; ok {
+			present[key] = value
+		}
+	}
 	return present, nil
 }
 
-func (r MockClient) incrementHash(key, field string) error {
+func (r MockClient) getHashes(keys ...string) ([]map[string]string, error) {
+	defer r.lock()()
+	hashes := make([]map[string]string, len(keys))
+	for i, key := range keys {
+		hashes[i] = r.copyHash(key)
+	}
+	return hashes, nil
+}
+
+func (r MockClient) countUnique(keys ...string) ([]int64, error) {
+	defer r.lock()()
+	counts := make([]int64, len(keys))
+	for i, key := range keys {
+		counts[i] = int64(len(r.sets[key]))
+	}
+	return counts, nil
+}
+
+func (r MockClient) ping() error {
+	defer r.lock()()
+	return nil
+}
+
+func (r MockClient) close() error {
+	defer r.lock()()
+	return nil
+}
+
+// Stand-in for redis dropping a key once its TTL runs out
+func (r MockClient) expireKey(key string) {
+	delete(r.values, key)
+	delete(r.ttls, key)
+	delete(r.expires, key)
+}
+
+func (r MockClient) setHash(key string, fields map[string]string) error {
+	defer r.lock()()
 	mapp, present := r.hashes[key]
 	if !present {
-		r.hashes[key] = map[string]string{field: "1"}
-		return nil
+		mapp = make(map[string]string)
+		r.hashes[key] = mapp
 	}
 
-	value, present := mapp[field]
-	if !present {
-		mapp[field] = "1"
-		return nil
+	for field, value := range fields {
+		mapp[field] = value
 	}
+	return nil
+}
 
-	intValue, err := strconv.Atoi(value)
-	if err != nil {
-		return err
+// Returns a copy, like a real HGETALL would
+func (r MockClient) getHash(key string) (map[string]string, error) {
+	defer r.lock()()
+	return r.copyHash(key), nil
+}
+
+func (r MockClient) copyHash(key string) map[string]string {
+	hash := make(map[string]string)
+	for field, value := range r.hashes[key] {
+		hash[field] = value
+	}
+	return hash
+}
+
+func (r MockClient) hashExists(key string) (bool, error) {
+	defer r.lock()()
+	_, present := r.hashes[key]
+	return present, nil
+}
+
+func (r MockClient) applyBatch(batch Batch) error {
+	defer r.lock()()
+	for key, fields := range batch.Hashes {
+		r.increments[key] = append(r.increments[key], fields)
+		mapp, present := r.hashes[key]
+		if !present {
+			mapp = make(map[string]string)
+			r.hashes[key] = mapp
+		}
+
+		for field, by := range fields {
+			value, _ := strconv.ParseInt(mapp[field], 10, 64)
+			mapp[field] = strconv.FormatInt(value+by, 10)
+		}
+	}
+
+	for key, elements := range batch.Uniques {
+		if r.sets[key] == nil {
+			r.sets[key] = make(map[string]bool)
+		}
+		for _, element := range elements {
+			r.sets[key][element] = true
+		}
+	}
+
+	for key, members := range batch.Members {
+		if r.zsets[key] == nil {
+			r.zsets[key] = make(map[string]float64)
+		}
+		for member, by := range members {
+			r.zsets[key][member] += by
+		}
 	}
-	mapp[field] = strconv.Itoa(intValue + 1)
 	return nil
 }
 
 // Actual tests
 
+func TestMockStore(t *testing.T) {
+	testDatastore(t, func(clock *MockClock) Datastore {
+		return RedisStore{NewMockClient(clock), clock}
+	})
+}
+
 func TestGetURL(t *testing.T) {
 	mockStore, _ := CreateMockStore()
 	testValues := map[string]string{"blah": "google.com", "ghjk": "lmgtfy.com", "foobar": "boo.baz"}
@@ -109,7 +454,7 @@ func TestSaveURL(t *testing.T) {
 	testMap := map[string]string{"reddit.com": "d23wrT", "news.ycombinator.com": "bB40lN", "github.com": "d1Ymny"}
 
 	for longUrl, expectedShortURL := range testMap {
-		actualShortURL, err := mockStore.SaveURL(longUrl)
+		actualShortURL, _, err := mockStore.SaveURL(longUrl, time.Time{})
 		if err != nil {
 			t.Errorf("Error occurred: %s\n", err.Error())
 		}
@@ -124,6 +469,304 @@ func TestSaveURL(t *testing.T) {
 	}
 }
 
+func TestSaveURLExisting(t *testing.T) {
+	mockStore, _ := CreateMockStore()
+	first, _, err := mockStore.SaveURL("reddit.com", time.Time{})
+	if err != nil {
+		t.Fatalf("Error occurred: %s\n", err.Error())
+	}
+
+	second, _, err := mockStore.SaveURL("reddit.com", time.Time{})
+	if err != nil {
+		t.Fatalf("Error occurred: %s\n", err.Error())
+	}
+
+	if first != second {
+		t.Errorf("Expected short url: %s\nActual short url: %s\n", first, second)
+	}
+}
+
+func TestSaveURLCollision(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+
+	// Occupy the first two slots of reddit.com's hash sequence with other urls
+	mockClient.values["url:"+saltedHashUrl("reddit.com", 0)] = "example.com"
+	mockClient.values["url:"+saltedHashUrl("reddit.com", 1)] = "example.org"
+	expectedShortURL := saltedHashUrl("reddit.com", 2)
+
+	for i := 0; i < 2; i++ {
+		actualShortURL, _, err := mockStore.SaveURL("reddit.com", time.Time{})
+		if err != nil {
+			t.Fatalf("Error occurred: %s\n", err.Error())
+		}
+
+		if actualShortURL != expectedShortURL {
+			t.Errorf("Expected short url: %s\nActual short url: %s\n", expectedShortURL, actualShortURL)
+		}
+	}
+
+	expectedValues := map[string]string{
+		saltedHashUrl("reddit.com", 0): "example.com",
+		saltedHashUrl("reddit.com", 1): "example.org",
+		saltedHashUrl("reddit.com", 2): "reddit.com",
+	}
+	for shortURL, expected := range expectedValues {
+		if actual := mockClient.values["url:"+shortURL]; actual != expected {
+			t.Errorf("Key %s overwritten\nExpected: %s\nActual: %s\n", "url:"+shortURL, expected, actual)
+		}
+	}
+}
+
+func TestSaveURLExhausted(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+	for attempt := 0; attempt < maxHashAttempts; attempt++ {
+		mockClient.values["url:"+saltedHashUrl("reddit.com", attempt)] = "example.com"
+	}
+
+	_, _, err := mockStore.SaveURL("reddit.com", time.Time{})
+	if err != HashCollision {
+		t.Errorf("Expected: %v\nActual: %v\n", HashCollision, err)
+	}
+}
+
+func TestSaveAlias(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+
+	if _, err := mockStore.SaveAlias("spring-sale", "shop.com/spring", time.Time{}); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+
+	if actual := mockClient.values["url:spring-sale"]; actual != "shop.com/spring" {
+		t.Errorf("Expected: %s\nActual: %s\n", "shop.com/spring", actual)
+	}
+
+	// saving the same url again is fine
+	if _, err := mockStore.SaveAlias("spring-sale", "shop.com/spring", time.Time{}); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+
+	// but an alias holding another url is not
+	if _, err := mockStore.SaveAlias("blah", "shop.com/spring", time.Time{}); err != AliasTaken {
+		t.Errorf("Expected: %v\nActual: %v\n", AliasTaken, err)
+	}
+
+	if actual := mockClient.values["url:blah"]; actual != "google.com" {
+		t.Errorf("Alias overwritten\nExpected: %s\nActual: %s\n", "google.com", actual)
+	}
+}
+
+func TestSaveURLExpiry(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+	expiresAt := MockNow.Add(48 * time.Hour)
+
+	shortURL, _, err := mockStore.SaveURL("reddit.com", expiresAt)
+	if err != nil {
+		t.Fatalf("Error occurred: %s\n", err.Error())
+	}
+
+	if ttl := mockClient.ttls["url:"+shortURL]; ttl != 48*time.Hour {
+		t.Errorf("Expected ttl: %v\nActual ttl: %v\n", 48*time.Hour, ttl)
+	}
+
+	if actual := mockClient.hashes["meta:"+shortURL]["ExpiresAt"]; actual != "2016-06-18T00:00:00Z" {
+		t.Errorf("Expected expiry: %s\nActual expiry: %s\n", "2016-06-18T00:00:00Z", actual)
+	}
+
+	// The same url and expiry maps to the same link, a permanent one does not
+	again, _, _ := mockStore.SaveURL("reddit.com", expiresAt)
+	if again != shortURL {
+		t.Errorf("Expected short url: %s\nActual short url: %s\n", shortURL, again)
+	}
+
+	permanent, _, _ := mockStore.SaveURL("reddit.com", time.Time{})
+	if permanent == shortURL {
+		t.Errorf("Permanent link reused expiring short url %s", shortURL)
+	}
+
+	if _, present := mockClient.ttls["url:"+permanent]; present {
+		t.Errorf("Permanent link %s stored with a ttl", permanent)
+	}
+
+	if _, _, err := mockStore.SaveURL("reddit.com", MockNow.Add(-time.Hour)); err != LinkExpired {
+		t.Errorf("Expected: %v\nActual: %v\n", LinkExpired, err)
+	}
+}
+
+func TestGetURLExpired(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+	shortURL, _, _ := mockStore.SaveURL("reddit.com", MockNow.Add(time.Hour))
+
+	if actual, err := mockStore.GetURL(shortURL); err != nil || actual != "reddit.com" {
+		t.Errorf("Expected: %s\nActual: %s (%v)\n", "reddit.com", actual, err)
+	}
+
+	mockClient.expireKey("url:" + shortURL)
+	mockStore.Clock = MockClock{current: MockNow.Add(time.Hour)}
+
+	if _, err := mockStore.GetURL(shortURL); err != LinkExpired {
+		t.Errorf("Expected: %v\nActual: %v\n", LinkExpired, err)
+	}
+
+	// Expired codes stay reserved rather than being handed to another url
+	if _, err := mockStore.SaveAlias(shortURL, "example.com", time.Time{}); err != AliasTaken {
+		t.Errorf("Expected: %v\nActual: %v\n", AliasTaken, err)
+	}
+}
+
+func TestGetLink(t *testing.T) {
+	mockStore, _ := CreateMockStore()
+	expiresAt := MockNow.Add(time.Hour)
+	mockStore.SaveAlias("flash", "shop.com/flash", expiresAt)
+
+	expectedMap := map[string]Link{
+		"blah":  {Code: "blah", Url: "google.com", Hits: 1117},
+		"flash": {Code: "flash", Url: "shop.com/flash", Created: &MockNow, ExpiresAt: &expiresAt},
+	}
+	for shortURL, expected := range expectedMap {
+		actual, err := mockStore.GetLink(shortURL)
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err.Error())
+		}
+
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Expected: %+v\nActual: %+v\n", expected, actual)
+		}
+	}
+
+	if _, err := mockStore.GetLink("bazang"); err != NilValue {
+		t.Errorf("Expected: %v\nActual: %v\n", NilValue, err)
+	}
+}
+
+func TestUpdateURL(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+
+	if err := mockStore.UpdateURL("blah", "duckduckgo.com"); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+
+	if actual := mockClient.values["url:blah"]; actual != "duckduckgo.com" {
+		t.Errorf("Expected: %s\nActual: %s\n", "duckduckgo.com", actual)
+	}
+
+	if actual := mockClient.hashes["hits:blah"]["Total"]; actual != "1117" {
+		t.Errorf("Hits changed by update\nExpected: %s\nActual: %s\n", "1117", actual)
+	}
+
+	// Expiring links keep their remaining lifetime
+	mockStore.SaveAlias("flash", "shop.com/flash", MockNow.Add(time.Hour))
+	mockStore.Clock = MockClock{current: MockNow.Add(15 * time.Minute)}
+	mockStore.UpdateURL("flash", "shop.com/flash2")
+	if ttl := mockClient.ttls["url:flash"]; ttl != 45*time.Minute {
+		t.Errorf("Expected ttl: %v\nActual ttl: %v\n", 45*time.Minute, ttl)
+	}
+
+	if err := mockStore.UpdateURL("bazang", "duckduckgo.com"); err != NilValue {
+		t.Errorf("Expected: %v\nActual: %v\n", NilValue, err)
+	}
+
+	if _, present := mockClient.values["url:bazang"]; present {
+		t.Errorf("Update created missing link %s", "url:bazang")
+	}
+}
+
+func TestDeleteURL(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+
+	// Daily keys of days still in the hits hash, and of recent days rolled
+	// up into their month, are found without scanning
+	old := mockStore.UTCNow().AddDate(0, -3, 0).Format(hitsDateFormat)
+	recent := mockStore.UTCNow().AddDate(0, 0, -2).Format(hitsDateFormat)
+	mockClient.hashes["hits:blah"][old] = "3"
+	mockClient.sets["visitors:blah:"+old] = map[string]bool{"alice": true}
+	mockClient.zsets["top:"+old] = map[string]float64{"blah": 3, "ghjk": 1}
+	mockClient.zsets["top:"+recent] = map[string]float64{"blah": 1}
+
+	if err := mockStore.DeleteURL("blah"); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+
+	if _, present := mockClient.values["url:blah"]; present {
+		t.Errorf("Key %s not deleted", "url:blah")
+	}
+
+	if _, present := mockClient.hashes["hits:blah"]; present {
+		t.Errorf("Key %s not deleted", "hits:blah")
+	}
+
+	if _, present := mockClient.sets["visitors:blah:"+old]; present {
+		t.Errorf("Key %s not deleted", "visitors:blah:"+old)
+	}
+
+	for _, key := range []string{"top:" + old, "top:" + recent} {
+		if _, present := mockClient.zsets[key]["blah"]; present {
+			t.Errorf("blah not removed from %s", key)
+		}
+	}
+
+	if err := mockStore.DeleteURL("blah"); err != NilValue {
+		t.Errorf("Expected: %v\nActual: %v\n", NilValue, err)
+	}
+}
+
+func TestListURLs(t *testing.T) {
+	mockStore, _ := CreateMockStore()
+
+	links, cursor, err := mockStore.ListURLs("", 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expected := []Link{{Code: "blah", Url: "google.com", Hits: 1117}, {Code: "foobar", Url: "boo.baz", Hits: 7}}
+	if !reflect.DeepEqual(links, expected) || cursor != "foobar" {
+		t.Errorf("Expected: %+v (cursor %q)\nActual: %+v (cursor %q)\n", expected, "foobar", links, cursor)
+	}
+
+	// A link added before the cursor does not shift the next page
+	mockStore.SaveAlias("aaa", "example.com", time.Time{})
+	links, cursor, err = mockStore.ListURLs(cursor, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expected = []Link{{Code: "ghjk", Url: "lmgtfy.com", Hits: 387}}
+	if !reflect.DeepEqual(links, expected) || cursor != "" {
+		t.Errorf("Expected: %+v (cursor %q)\nActual: %+v (cursor %q)\n", expected, "", links, cursor)
+	}
+}
+
+func TestListURLsSkipsExpired(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+
+	// Expired links stay in the index, the page is filled from further on
+	mockClient.expireKey("url:blah")
+	links, cursor, err := mockStore.ListURLs("", 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expected := []Link{{Code: "foobar", Url: "boo.baz", Hits: 7}, {Code: "ghjk", Url: "lmgtfy.com", Hits: 387}}
+	if !reflect.DeepEqual(links, expected) || cursor != "" {
+		t.Errorf("Expected: %+v (cursor %q)\nActual: %+v (cursor %q)\n", expected, "", links, cursor)
+	}
+}
+
+func TestIndexLinks(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+	delete(mockClient.zsets, linksKey)
+	if links, _, _ := mockStore.ListURLs("", 10); len(links) != 0 {
+		t.Errorf("Expected no links listed before indexing\nActual: %+v", links)
+	}
+
+	if indexed, err := mockStore.IndexLinks(); err != nil || indexed != 3 {
+		t.Errorf("Expected: %d\nActual: %d, %v", 3, indexed, err)
+	}
+
+	if links, _, _ := mockStore.ListURLs("", 10); len(links) != 3 {
+		t.Errorf("Expected %d links listed\nActual: %+v", 3, links)
+	}
+}
+
 func DateFromDays(yearDays int, clock Clock) time.Time {
 	t := time.Date(2016, time.January, yearDays, 0, 0, 0, 0, time.UTC)
 	if t.After(clock.UTCNow()) {
@@ -156,17 +799,543 @@ func TestGetHits(t *testing.T) {
 func TestIncrementHits(t *testing.T) {
 	mockStore, mockClient := CreateMockStore()
 	expectedMap := map[string]map[string]string{
-		"blah":   {"Total": "1118", "1": "78", "168": "35", "296": "672"},
-		"ghjk":   {"Total": "388", "3": "31", "204": "14", "308": "76", "168": "1"},
-		"foobar": {"Total": "8", "86": "4", "287": "1", "365": "2", "168": "1"},
-		"baz":    {"Total": "1", "168": "1"},
+		"blah":   {"Total": "1118", "1": "78", "168": "34", "296": "672", "2016-06-16": "1", "2016-06-16T00": "1"},
+		"ghjk":   {"Total": "388", "3": "31", "204": "14", "308": "76", "2016-06-16": "1", "2016-06-16T00": "1"},
+		"foobar": {"Total": "8", "86": "4", "287": "1", "365": "2", "2016-06-16": "1", "2016-06-16T00": "1"},
+		"baz":    {"Total": "1", "2016-06-16": "1", "2016-06-16T00": "1"},
 	}
 
 	for key, expectedValue := range expectedMap {
-		mockStore.IncrementHits(key)
+		mockStore.IncrementHits(key, Visit{Visitor: "visitor"})
 		actualValue := mockClient.hashes["hits:"+key]
 		if !reflect.DeepEqual(actualValue, expectedValue) {
 			t.Errorf("Expected hash value: %#v\nActual hash value: %#v\n", expectedValue, actualValue)
 		}
 	}
 }
+
+func TestIncrementHitsAtomic(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+	mockStore.IncrementHits("blah", Visit{Visitor: "visitor"})
+	mockStore.IncrementHits("blah", Visit{Visitor: "visitor"})
+
+	// Total and the day only ever move together, in one call per hit
+	hit := map[string]int64{"Total": 1, "2016-06-16": 1, "2016-06-16T00": 1}
+	expected := []map[string]int64{hit, hit}
+	if actual := mockClient.increments["hits:blah"]; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected increments: %v\nActual increments: %v\n", expected, actual)
+	}
+}
+
+func TestRecordHits(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+	later := MockNow.Add(25 * time.Hour)
+	hits := []Hit{
+		{Code: "baz", Visit: Visit{Visitor: "alice", Referrer: "direct"}, Time: MockNow},
+		{Code: "baz", Visit: Visit{Visitor: "bob", Referrer: "direct"}, Time: MockNow},
+		{Code: "baz", Visit: Visit{Visitor: "alice", Referrer: "twitter.com"}, Time: later},
+		{Code: "blah", Visit: Visit{Visitor: "alice"}, Time: later},
+	}
+	mockStore.RecordHits(hits)
+
+	// Hits are counted at the time they happened, summed into one call
+	expected := []map[string]int64{{"Total": 3, "2016-06-16": 2, "2016-06-16T00": 2, "2016-06-17": 1, "2016-06-17T01": 1}}
+	if actual := mockClient.increments["hits:baz"]; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected increments: %v\nActual increments: %v\n", expected, actual)
+	}
+
+	actual, _ := mockStore.GetHits("baz")
+	if actual.Unique != 2 || actual.UniqueDays[MockNow] != 2 || actual.UniqueDays[MockNow.AddDate(0, 0, 1)] != 1 {
+		t.Errorf("Expected %d unique visitors, %d then %d a day\nActual: %+v", 2, 2, 1, actual)
+	}
+
+	expectedReferrers := []Tally{{"direct", 2}, {"twitter.com", 1}}
+	if !reflect.DeepEqual(actual.Referrers, expectedReferrers) {
+		t.Errorf("Expected: %v\nActual: %v\n", expectedReferrers, actual.Referrers)
+	}
+
+	if count := len(mockClient.increments["hits:blah"]); count != 1 {
+		t.Errorf("Expected %d call for %s, actual %d", 1, "hits:blah", count)
+	}
+
+	if err := mockStore.RecordHits(nil); err != nil || len(mockClient.increments) != 2 {
+		t.Errorf("Expected an empty batch to do nothing\nActual: %v, %v", err, mockClient.increments)
+	}
+}
+
+func TestRecordBotHits(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+	hits := []Hit{
+		{Code: "baz", Visit: Visit{Visitor: "slack", Referrer: "direct", Bot: "Slackbot"}, Time: MockNow},
+		{Code: "baz", Visit: Visit{Visitor: "slack", Referrer: "direct", Bot: "Slackbot"}, Time: MockNow},
+		{Code: "baz", Visit: Visit{Visitor: "checker", Bot: "HEAD"}, Time: MockNow.AddDate(0, 0, 1)},
+	}
+	mockStore.RecordHits(hits)
+
+	// Links only bots have visited still have stats
+	actual, err := mockStore.GetHits("baz")
+	if err != nil {
+		t.Fatalf("Error occurred: %s\n", err.Error())
+	}
+
+	expected := NewHits()
+	expected.Bots = 3
+	expected.BotDays = map[time.Time]int{MockNow: 2, MockNow.AddDate(0, 0, 1): 1}
+	expected.BotAgents = []Tally{{"Slackbot", 2}, {"HEAD", 1}}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected: %+v\nActual: %+v\n", expected, actual)
+	}
+
+	// People are counted as before, and bots stay out of their numbers
+	mockStore.IncrementHits("baz", Visit{Visitor: "alice", Referrer: "direct"})
+	actual, _ = mockStore.GetHits("baz")
+	if actual.Count != 1 || actual.Unique != 1 || !reflect.DeepEqual(actual.Referrers, []Tally{{"direct", 1}}) {
+		t.Errorf("Expected %d hit by %d visitor from %s\nActual: %+v", 1, 1, "direct", actual)
+	}
+
+	// Bot days are rolled up with the rest
+	mockStore.Clock = MockClock{current: MockNow.AddDate(0, 0, 2)}
+	mockStore.CompactHits(RetentionPolicy{Days: 24 * time.Hour})
+	expectedHash := map[string]string{"Total": "3", "2016-06": "2", "2016-06-17": "1"}
+	if actualHash := mockClient.hashes["bothits:baz"]; !reflect.DeepEqual(actualHash, expectedHash) {
+		t.Errorf("Expected: %v\nActual: %v\n", expectedHash, actualHash)
+	}
+
+	mockStore.DeleteURL("baz")
+	for _, key := range []string{"bothits:baz", "bots:baz"} {
+		if _, present := mockClient.hashes[key]; present {
+			t.Errorf("Key %s not deleted", key)
+		}
+		if _, present := mockClient.zsets[key]; present {
+			t.Errorf("Key %s not deleted", key)
+		}
+	}
+}
+
+func TestTopLinks(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+	hits := []Hit{
+		{Code: "blah", Time: MockNow},
+		{Code: "ghjk", Time: MockNow},
+		{Code: "ghjk", Time: MockNow},
+		{Code: "blah", Time: MockNow.AddDate(0, 0, -3)},
+		{Code: "blah", Time: MockNow.AddDate(0, 0, -3)},
+		{Code: "foobar", Time: MockNow.AddDate(0, 0, -20)},
+		{Code: "foobar", Time: MockNow.AddDate(0, 0, -20)},
+		{Code: "foobar", Time: MockNow.AddDate(0, 0, -20)},
+		{Code: "foobar", Time: MockNow.AddDate(0, 0, -20), Visit: Visit{Bot: "Slackbot"}},
+	}
+	mockStore.RecordHits(hits)
+
+	expectedMap := map[int][]TopLink{
+		1:  {{"ghjk", "lmgtfy.com", 2}, {"blah", "google.com", 1}},
+		7:  {{"blah", "google.com", 3}, {"ghjk", "lmgtfy.com", 2}},
+		30: {{"foobar", "boo.baz", 3}, {"blah", "google.com", 3}, {"ghjk", "lmgtfy.com", 2}},
+	}
+	for days, expected := range expectedMap {
+		actual, err := mockStore.TopLinks(days, 10)
+		if err != nil || !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Days: %d\nExpected: %v\nActual: %v, %v", days, expected, actual, err)
+		}
+	}
+
+	if actual, _ := mockStore.TopLinks(30, 1); len(actual) != 1 {
+		t.Errorf("Expected %d link\nActual: %v", 1, actual)
+	}
+
+	// Deleted links drop out, expired ones are skipped
+	mockStore.DeleteURL("blah")
+	mockClient.expireKey("url:ghjk")
+	expected := []TopLink{{"foobar", "boo.baz", 3}}
+	if actual, _ := mockStore.TopLinks(30, 10); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected: %v\nActual: %v", expected, actual)
+	}
+
+	// Days past the longest period are dropped by compaction
+	mockStore.Clock = MockClock{current: MockNow.AddDate(0, 0, 11)}
+	mockStore.CompactHits(RetentionPolicy{})
+	if _, present := mockClient.zsets[topKey(MockNow.AddDate(0, 0, -20))]; present {
+		t.Errorf("Key %s not dropped", topKey(MockNow.AddDate(0, 0, -20)))
+	}
+
+	if _, present := mockClient.zsets[topKey(MockNow)]; !present {
+		t.Errorf("Key %s dropped within retention", topKey(MockNow))
+	}
+}
+
+func TestGetHitsAcrossYears(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+	mockClient.hashes["hits:blah"] = map[string]string{"Total": "12", "2015-02-19": "5", "2016-02-19": "7"}
+
+	expected := Hits{Count: 12, Days: map[time.Time]int{
+		time.Date(2015, time.February, 19, 0, 0, 0, 0, time.UTC): 5,
+		time.Date(2016, time.February, 19, 0, 0, 0, 0, time.UTC): 7,
+	}}
+	actual, err := mockStore.GetHits("blah")
+	if err != nil {
+		t.Errorf("Error occurred: %s\n", err.Error())
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected: %v\nActual: %v\n", expected, actual)
+	}
+}
+
+func TestMigrateHits(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+	mockClient.hashes["hits:baz"] = map[string]string{"Total": "3", "2016-06-16": "1", "168": "2"}
+	before, _ := mockStore.GetHits("blah")
+
+	migrated, err := mockStore.MigrateHits()
+	if err != nil {
+		t.Fatalf("Error occurred: %s\n", err.Error())
+	}
+
+	if migrated != 4 {
+		t.Errorf("Expected %d hashes migrated, actual %d", 4, migrated)
+	}
+
+	expectedMap := map[string]map[string]string{
+		"blah":   {"Total": "1117", "2016-01-01": "78", "2016-06-16": "34", "2015-10-22": "672"},
+		"foobar": {"Total": "7", "2016-03-26": "4", "2015-10-13": "1", "2015-12-30": "2"},
+		"baz":    {"Total": "3", "2016-06-16": "3"},
+	}
+	for key, expected := range expectedMap {
+		if actual := mockClient.hashes["hits:"+key]; !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Expected hash value: %#v\nActual hash value: %#v\n", expected, actual)
+		}
+	}
+
+	// Stats read the same before and after
+	after, _ := mockStore.GetHits("blah")
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("Expected: %v\nActual: %v\n", before, after)
+	}
+
+	// Running it again is a no-op
+	if migrated, _ := mockStore.MigrateHits(); migrated != 0 {
+		t.Errorf("Expected %d hashes migrated, actual %d", 0, migrated)
+	}
+}
+
+func TestGetHitsPeriods(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+	mockClient.hashes["hits:blah"] = map[string]string{
+		"Total": "60", "2015-03": "40", "2016-06-15": "12", "2016-06-16": "8", "2016-06-16T09": "3", "2016-06-16T14": "5",
+	}
+
+	expected := Hits{
+		Count:  60,
+		Days:   map[time.Time]int{date(2016, time.June, 15): 12, date(2016, time.June, 16): 8},
+		Hours:  map[time.Time]int{MockNow.Add(9 * time.Hour): 3, MockNow.Add(14 * time.Hour): 5},
+		Months: map[time.Time]int{date(2015, time.March, 1): 40},
+	}
+	actual, err := mockStore.GetHits("blah")
+	if err != nil {
+		t.Errorf("Error occurred: %s\n", err.Error())
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected: %v\nActual: %v\n", expected, actual)
+	}
+}
+
+func TestCompactHits(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+	mockStore.Clock = MockClock{current: MockNow.Add(12 * time.Hour)}
+	mockClient.hashes["hits:blah"] = map[string]string{
+		"Total": "71", "2016-03": "1",
+		"2016-03-30": "10", "2016-03-31": "20", "2016-04-01": "30", "2016-06-16": "10",
+		"2016-06-15T10": "4", "2016-06-16T09": "6", "2016-06-16T11": "4",
+	}
+	delete(mockClient.hashes, "hits:ghjk")
+	delete(mockClient.hashes, "hits:foobar")
+
+	compacted, err := mockStore.CompactHits(RetentionPolicy{Hours: 2 * time.Hour, Days: 76 * 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("Error occurred: %s\n", err.Error())
+	}
+
+	if compacted != 1 {
+		t.Errorf("Expected %d hashes compacted, actual %d", 1, compacted)
+	}
+
+	expected := map[string]string{
+		"Total": "71", "2016-03": "31", "2016-04-01": "30", "2016-06-16": "10", "2016-06-16T11": "4",
+	}
+	if actual := mockClient.hashes["hits:blah"]; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected hash value: %#v\nActual hash value: %#v\n", expected, actual)
+	}
+
+	// Zero retention keeps everything
+	if compacted, _ := mockStore.CompactHits(RetentionPolicy{}); compacted != 0 {
+		t.Errorf("Expected %d hashes compacted, actual %d", 0, compacted)
+	}
+}
+
+func TestUniqueVisitors(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+	for _, visitor := range []string{"alice", "bob", "alice", "alice"} {
+		mockStore.IncrementHits("baz", Visit{Visitor: visitor})
+	}
+
+	// and alice again the next day
+	mockStore.Clock = MockClock{current: MockNow.AddDate(0, 0, 1)}
+	mockStore.IncrementHits("baz", Visit{Visitor: "alice"})
+
+	hits, err := mockStore.GetHits("baz")
+	if err != nil {
+		t.Fatalf("Error occurred: %s\n", err.Error())
+	}
+
+	if hits.Count != 5 || hits.Unique != 2 {
+		t.Errorf("Expected %d hits from %d visitors, actual %d from %d", 5, 2, hits.Count, hits.Unique)
+	}
+
+	expected := map[time.Time]int{MockNow: 2, MockNow.AddDate(0, 0, 1): 1}
+	if !reflect.DeepEqual(hits.UniqueDays, expected) {
+		t.Errorf("Expected: %v\nActual: %v\n", expected, hits.UniqueDays)
+	}
+
+	// Daily visitor counts go once their day is past retention, and with
+	// the link
+	mockStore.Clock = MockClock{current: MockNow.AddDate(0, 0, 2)}
+	mockStore.CompactHits(RetentionPolicy{Days: 24 * time.Hour})
+	if _, present := mockClient.sets["visitors:baz:2016-06-16"]; present {
+		t.Errorf("Key %s not dropped", "visitors:baz:2016-06-16")
+	}
+
+	if _, present := mockClient.sets["visitors:baz:2016-06-17"]; !present {
+		t.Errorf("Key %s dropped within retention", "visitors:baz:2016-06-17")
+	}
+
+	mockStore.DeleteURL("baz")
+	for key := range mockClient.sets {
+		t.Errorf("Key %s not deleted", key)
+	}
+}
+
+func TestBreakdowns(t *testing.T) {
+	mockStore, mockClient := CreateMockStore()
+	visits := []Visit{
+		{Visitor: "a", Referrer: "twitter.com", Browser: "Chrome", OS: "Android", Device: "mobile", Country: "DE", City: "Berlin, DE"},
+		{Visitor: "b", Referrer: "twitter.com", Browser: "Safari", OS: "iOS", Device: "mobile", Country: "DE"},
+		{Visitor: "c", Referrer: "direct", Browser: "Firefox", OS: "Windows", Device: "desktop"},
+	}
+	for _, visit := range visits {
+		mockStore.IncrementHits("baz", visit)
+	}
+
+	hits, err := mockStore.GetHits("baz")
+	if err != nil {
+		t.Fatalf("Error occurred: %s\n", err.Error())
+	}
+
+	expectedReferrers := []Tally{{"twitter.com", 2}, {"direct", 1}}
+	if !reflect.DeepEqual(hits.Referrers, expectedReferrers) {
+		t.Errorf("Expected: %v\nActual: %v\n", expectedReferrers, hits.Referrers)
+	}
+
+	expectedDevices := []Tally{{"mobile", 2}, {"desktop", 1}}
+	if !reflect.DeepEqual(hits.Devices, expectedDevices) {
+		t.Errorf("Expected: %v\nActual: %v\n", expectedDevices, hits.Devices)
+	}
+
+	// Visits GeoIP could not place are left out
+	expectedCountries := []Tally{{"DE", 2}}
+	if !reflect.DeepEqual(hits.Countries, expectedCountries) {
+		t.Errorf("Expected: %v\nActual: %v\n", expectedCountries, hits.Countries)
+	}
+
+	expectedCities := []Tally{{"Berlin, DE", 1}}
+	if !reflect.DeepEqual(hits.Cities, expectedCities) {
+		t.Errorf("Expected: %v\nActual: %v\n", expectedCities, hits.Cities)
+	}
+
+	if len(hits.Browsers) != 3 || len(hits.OS) != 3 {
+		t.Errorf("Expected %d browsers and operating systems, actual %v and %v", 3, hits.Browsers, hits.OS)
+	}
+
+	// Long tails of referrers and cities are trimmed by compaction
+	for i := 0; i < breakdownRetained+20; i++ {
+		mockStore.IncrementHits("baz", Visit{Referrer: "site" + strconv.Itoa(i) + ".com", City: "Town" + strconv.Itoa(i) + ", DE"})
+	}
+	mockStore.CompactHits(RetentionPolicy{})
+	if size := len(mockClient.zsets["referrers:baz"]); size != breakdownRetained {
+		t.Errorf("Expected %d referrers kept, actual %d", breakdownRetained, size)
+	}
+
+	if size := len(mockClient.zsets["cities:baz"]); size != breakdownRetained {
+		t.Errorf("Expected %d cities kept, actual %d", breakdownRetained, size)
+	}
+
+	if mockClient.zsets["referrers:baz"]["twitter.com"] != 2 {
+		t.Errorf("Top referrer %s trimmed", "twitter.com")
+	}
+
+	mockStore.DeleteURL("baz")
+	for key := range mockClient.zsets {
+		if key != linksKey {
+			t.Errorf("Key %s not deleted", key)
+		}
+	}
+	if _, present := mockClient.zsets[linksKey]["baz"]; present {
+		t.Errorf("Expected %s dropped from the links index", "baz")
+	}
+}
+
+// A RedisClient talking to a fake server, which answers every command with
+// the reply fn gives for it and notes down the command's name
+func FakeRedisClient(fn func(args []string) string) (RedisClient, *[]string) {
+	var mu sync.Mutex
+	var commands []string
+	dial := func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			reader := bufio.NewReader(server)
+			for {
+				args, err := readCommand(reader)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				commands = append(commands, strings.ToUpper(args[0]))
+				mu.Unlock()
+				if _, err := server.Write([]byte(fn(args))); err != nil {
+					return
+				}
+			}
+		}()
+		return client, nil
+	}
+	return NewRedisClient(&redis.Options{Dialer: dial}), &commands
+}
+
+// Reads one command, an array of bulk strings, off a client connection
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func TestRedisApplyBatch(t *testing.T) {
+	var sent []string
+	client, commands := FakeRedisClient(func(args []string) string {
+		sent = args
+		return ":1\r\n"
+	})
+	defer client.Close()
+
+	batch := NewBatch()
+	batch.Hashes["hits:baz"] = map[string]int64{"count": 2}
+	batch.Uniques["visitors:baz"] = []string{"a", "b"}
+	batch.Members["referrers:baz"] = map[string]float64{"reddit.com": 2}
+	if err := client.applyBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(*commands, []string{"EVALSHA"}) {
+		t.Fatalf("Batch should be applied with one EVALSHA, sent %v", *commands)
+	}
+	// EVALSHA sha numkeys key... arg...
+	if sent[2] != "3" || len(sent) != 3+3+4+5+4 {
+		t.Errorf("Unexpected script call %v", sent)
+	}
+}
+
+func TestRedisApplyBatchEmpty(t *testing.T) {
+	client, commands := FakeRedisClient(func(args []string) string {
+		return ":1\r\n"
+	})
+	defer client.Close()
+
+	if err := client.applyBatch(NewBatch()); err != nil {
+		t.Fatal(err)
+	}
+	if len(*commands) != 0 {
+		t.Errorf("Empty batch should send nothing, sent %v", *commands)
+	}
+}
+
+func TestRedisApplyBatchLoadsScript(t *testing.T) {
+	client, commands := FakeRedisClient(func(args []string) string {
+		if strings.ToUpper(args[0]) == "EVALSHA" {
+			return "-NOSCRIPT No matching script\r\n"
+		}
+		return ":1\r\n"
+	})
+	defer client.Close()
+
+	batch := NewBatch()
+	batch.Hashes["hits:baz"] = map[string]int64{"count": 1}
+	if err := client.applyBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*commands, []string{"EVALSHA", "EVAL"}) {
+		t.Errorf("Unknown script should be sent with EVAL, sent %v", *commands)
+	}
+}
+
+func TestRedisUnionMembers(t *testing.T) {
+	client, commands := FakeRedisClient(func(args []string) string {
+		return "*4\r\n$3\r\nbaz\r\n$1\r\n3\r\n$4\r\nblah\r\n$1\r\n2\r\n"
+	})
+	defer client.Close()
+
+	tallies, err := client.unionMembers(2, "referrers:baz:1", "referrers:baz:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Tally{{Name: "baz", Hits: 3}, {Name: "blah", Hits: 2}}
+	if !reflect.DeepEqual(tallies, expected) {
+		t.Errorf("Expected %v, got %v", expected, tallies)
+	}
+	if !reflect.DeepEqual(*commands, []string{"EVALSHA"}) {
+		t.Errorf("Union should take one EVALSHA, sent %v", *commands)
+	}
+}
+
+func TestRedisTopLinks(t *testing.T) {
+	client, commands := FakeRedisClient(func(args []string) string {
+		if strings.ToUpper(args[0]) == "MGET" {
+			return "*2\r\n$10\r\ngoogle.com\r\n$-1\r\n"
+		}
+		return "*4\r\n$4\r\nblah\r\n$1\r\n3\r\n$4\r\nghjk\r\n$1\r\n2\r\n"
+	})
+	defer client.Close()
+	store := RedisStore{client, MockClock{current: MockNow}}
+
+	links, err := store.TopLinks(7, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []TopLink{{"blah", "google.com", 3}}
+	if !reflect.DeepEqual(links, expected) {
+		t.Errorf("Expected: %v\nActual: %v", expected, links)
+	}
+	if !reflect.DeepEqual(*commands, []string{"EVALSHA", "MGET"}) {
+		t.Errorf("Urls should be read with one MGET, sent %v", *commands)
+	}
+}
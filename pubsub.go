@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"gopkg.in/redis.v4"
+)
+
+// Every instance keeps its own UrlCache, so a link changed through one
+// instance has to be evicted everywhere else too.  Mutations are published
+// on a channel of the shared store that all instances listen on, a Redis
+// channel or a PostgreSQL NOTIFY channel.
+
+const invalidationChannel = "shortener:invalidate"
+
+// How long to wait for a message before pinging to check the connection
+const subscriptionPingInterval = 30 * time.Second
+
+// Longest pause between attempts while the store is unreachable
+const maxSubscriptionBackoff = 30 * time.Second
+
+type Invalidator interface {
+	// Tell every instance, including this one, to evict short_url
+	Publish(string) error
+	// Blocks until Close, calling evict for each short url published and
+	// flush whenever messages may have been missed
+	Listen(evict func(string), flush func())
+	Close() error
+}
+
+// The parts of *redis.PubSub used by the listener
+type subscription interface {
+	ReceiveTimeout(time.Duration) (interface{}, error)
+	Ping(string) error
+	Close() error
+}
+
+type RedisInvalidator struct {
+	client    *redis.Client
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu     sync.Mutex // protects pubsub
+	pubsub subscription
+}
+
+func NewRedisInvalidator(client *redis.Client) *RedisInvalidator {
+	return &RedisInvalidator{client: client, done: make(chan struct{})}
+}
+
+func (i *RedisInvalidator) Publish(short_url string) error {
+	return i.client.Publish(invalidationChannel, short_url).Err()
+}
+
+func (i *RedisInvalidator) Listen(evict func(string), flush func()) {
+	// redis.PubSub only resubscribes to channels it has subscribed to
+	// successfully once, so keep trying until the first SUBSCRIBE goes out
+	pubsub, err := i.client.Subscribe(invalidationChannel)
+	for backoff := time.Second; err != nil; backoff = nextBackoff(backoff) {
+		log.Printf("Could not subscribe to %s, retrying in %v: %s", invalidationChannel, backoff, err.Error())
+		if i.sleep(backoff) {
+			pubsub.Close()
+			return
+		}
+		err = pubsub.Subscribe(invalidationChannel)
+	}
+
+	i.mu.Lock()
+	i.pubsub = pubsub
+	i.mu.Unlock()
+	i.listen(pubsub, evict, flush)
+}
+
+// The connection is re-established by redis.PubSub itself, each new
+// subscription is confirmed with a *redis.Subscription message.  Anything
+// published before that was missed, so the whole cache is flushed.
+func (i *RedisInvalidator) listen(pubsub subscription, evict func(string), flush func()) {
+	backoff := time.Second
+	for {
+		msg, err := pubsub.ReceiveTimeout(subscriptionPingInterval)
+		select {
+		case <-i.done:
+			return
+		default:
+		}
+
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			// Quiet channel, make sure the connection is still alive
+			if err := pubsub.Ping(""); err != nil {
+				log.Printf("Invalidation subscription ping failed: %s", err.Error())
+			}
+			continue
+		}
+
+		if err != nil {
+			log.Printf("Invalidation subscription dropped, retrying in %v: %s", backoff, err.Error())
+			if i.sleep(backoff) {
+				return
+			}
+			backoff = nextBackoff(backoff)
+			continue
+		}
+
+		backoff = time.Second
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			flush()
+		case *redis.Message:
+			evict(m.Payload)
+		}
+	}
+}
+
+// Waits for d, returning true early if the invalidator was closed meanwhile
+func (i *RedisInvalidator) sleep(d time.Duration) bool {
+	select {
+	case <-i.done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff *= 2; backoff > maxSubscriptionBackoff {
+		return maxSubscriptionBackoff
+	}
+	return backoff
+}
+
+// Safe to call more than once, only the first call closes anything
+func (i *RedisInvalidator) Close() error {
+	var err error
+	i.closeOnce.Do(func() {
+		close(i.done)
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		if i.pubsub != nil {
+			err = i.pubsub.Close()
+		}
+	})
+	return err
+}
+
+// PostgresInvalidator publishes with NOTIFY on the database the SQL store
+// keeps links in, and listens on a connection of its own.  pq.Listener
+// reconnects by itself and sends a nil notification once it has, as
+// anything published in between was missed.
+type PostgresInvalidator struct {
+	db       *sql.DB
+	listener *pq.Listener
+}
+
+func NewPostgresInvalidator(db *sql.DB, source string) *PostgresInvalidator {
+	listener := pq.NewListener(source, time.Second, maxSubscriptionBackoff, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Invalidation listener %s: %s", event, err.Error())
+		}
+	})
+	return &PostgresInvalidator{db, listener}
+}
+
+func (i *PostgresInvalidator) Publish(short_url string) error {
+	_, err := i.db.Exec(`SELECT pg_notify($1, $2)`, invalidationChannel, short_url)
+	return err
+}
+
+func (i *PostgresInvalidator) Listen(evict func(string), flush func()) {
+	// Blocks until connected, failing only once closed or if the server
+	// refuses
+	if err := i.listener.Listen(invalidationChannel); err != nil {
+		if err != net.ErrClosed {
+			log.Printf("Could not listen on %s: %s", invalidationChannel, err.Error())
+		}
+		return
+	}
+	listenForNotifications(i.listener.Notify, i.listener.Ping, evict, flush)
+}
+
+// Runs until notify is closed, pinging whenever it has been quiet for a while
+func listenForNotifications(notify <-chan *pq.Notification, ping func() error, evict func(string), flush func()) {
+	for {
+		select {
+		case n, ok := <-notify:
+			if !ok {
+				return
+			}
+			if n == nil {
+				flush()
+				continue
+			}
+			evict(n.Extra)
+		case <-time.After(subscriptionPingInterval):
+			if err := ping(); err != nil {
+				log.Printf("Invalidation listener ping failed: %s", err.Error())
+			}
+		}
+	}
+}
+
+// Closing the listener closes its notification channel, ending Listen
+func (i *PostgresInvalidator) Close() error {
+	return i.listener.Close()
+}
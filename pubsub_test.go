@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"gopkg.in/redis.v4"
+)
+
+// Mock invalidation broker, delivers every publish to all listeners in
+// process
+
+type MockBroker struct {
+	mu        sync.Mutex
+	published []string
+	listeners []func(string)
+}
+
+func (b *MockBroker) Publish(short_url string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = append(b.published, short_url)
+	for _, evict := range b.listeners {
+		evict(short_url)
+	}
+	return nil
+}
+
+func (b *MockBroker) Listen(evict func(string), flush func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.listeners = append(b.listeners, evict)
+}
+
+func (b *MockBroker) Close() error {
+	return nil
+}
+
+// Mock subscription, replays a fixed script of replies
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+type MockSubscription struct {
+	replies []interface{}
+	pings   int
+	closes  int
+	done    chan struct{}
+}
+
+func (m *MockSubscription) ReceiveTimeout(time.Duration) (interface{}, error) {
+	if len(m.replies) == 0 {
+		close(m.done)
+		return nil, errors.New("redis: client is closed")
+	}
+
+	reply := m.replies[0]
+	m.replies = m.replies[1:]
+	if err, ok := reply.(error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (m *MockSubscription) Ping(string) error {
+	m.pings++
+	return nil
+}
+
+func (m *MockSubscription) Close() error {
+	m.closes++
+	return nil
+}
+
+// Actual tests
+
+func TestInvalidatorListen(t *testing.T) {
+	var events []string
+	evict := func(short_url string) { events = append(events, "evict "+short_url) }
+	flush := func() { events = append(events, "flush") }
+
+	done := make(chan struct{})
+	sub := &MockSubscription{done: done, replies: []interface{}{
+		&redis.Subscription{Kind: "subscribe", Channel: invalidationChannel, Count: 1},
+		&redis.Message{Channel: invalidationChannel, Payload: "blah"},
+		timeoutError{},
+		&redis.Pong{},
+		// Reconnected after a dropped connection
+		&redis.Subscription{Kind: "subscribe", Channel: invalidationChannel, Count: 1},
+		&redis.Message{Channel: invalidationChannel, Payload: "ghjk"},
+	}}
+
+	invalidator := &RedisInvalidator{done: done}
+	invalidator.listen(sub, evict, flush)
+
+	expected := []string{"flush", "evict blah", "flush", "evict ghjk"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected: %v\nActual: %v\n", expected, events)
+	}
+
+	if sub.pings != 1 {
+		t.Errorf("Expected %d ping after a timeout, actual %d", 1, sub.pings)
+	}
+}
+
+func TestRedisInvalidatorClose(t *testing.T) {
+	sub := &MockSubscription{}
+	invalidator := &RedisInvalidator{done: make(chan struct{}), pubsub: sub}
+	invalidator.Close()
+	if err := invalidator.Close(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	if sub.closes != 1 {
+		t.Errorf("Expected the subscription closed %d time, actual %d", 1, sub.closes)
+	}
+}
+
+func TestNotificationListen(t *testing.T) {
+	var events []string
+	evict := func(short_url string) { events = append(events, "evict "+short_url) }
+	flush := func() { events = append(events, "flush") }
+
+	notify := make(chan *pq.Notification, 3)
+	notify <- &pq.Notification{Channel: invalidationChannel, Extra: "blah"}
+	// Reconnected after a dropped connection
+	notify <- nil
+	notify <- &pq.Notification{Channel: invalidationChannel, Extra: "ghjk"}
+	close(notify)
+
+	listenForNotifications(notify, func() error { return nil }, evict, flush)
+
+	expected := []string{"evict blah", "flush", "evict ghjk"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected: %v\nActual: %v\n", expected, events)
+	}
+}
+
+// Needs the PostgreSQL database SQL_TEST_STORE names
+func TestPostgresInvalidator(t *testing.T) {
+	driver, source, ok := SQLSource(os.Getenv("SQL_TEST_STORE"))
+	if !ok || driver != "postgres" {
+		t.Skip("SQL_TEST_STORE does not name a PostgreSQL database")
+	}
+	store := openTestSQLStore(t, driver, source, &MockClock{current: MockNow})
+	defer store.Close()
+
+	invalidator := NewPostgresInvalidator(store.db, source)
+	evicted := make(chan string, 1)
+	done := make(chan struct{})
+	go func() {
+		invalidator.Listen(func(short_url string) { evicted <- short_url }, func() {})
+		close(done)
+	}()
+
+	// Notifications sent before LISTEN goes out are not delivered
+	deadline := time.After(5 * time.Second)
+	for received := false; !received; {
+		if err := invalidator.Publish("blah"); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		select {
+		case short_url := <-evicted:
+			if short_url != "blah" {
+				t.Errorf("Expected: %s\nActual: %s", "blah", short_url)
+			}
+			received = true
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("Expected a notification within 5s")
+		}
+	}
+
+	invalidator.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected Listen to return after Close")
+	}
+}
+
+func TestInvalidationAcrossServers(t *testing.T) {
+	mockStore, _ := CreateMockStore()
+	broker := &MockBroker{}
+
+	servers := []Server{NewServer(mockStore, mockStore.Clock), NewServer(mockStore, mockStore.Clock)}
+	for i := range servers {
+		servers[i].Invalidator = broker
+		servers[i].listenForInvalidations()
+		servers[i].lookupUrl("blah")
+	}
+
+	mockStore.UpdateURL("blah", "bing.com")
+	servers[0].invalidateUrl("blah")
+
+	for i, server := range servers {
+		if actual, _ := server.lookupUrl("blah"); actual != "bing.com" {
+			t.Errorf("Server %d expected: %s\nActual: %s\n", i, "bing.com", actual)
+		}
+	}
+
+	if !reflect.DeepEqual(broker.published, []string{"blah"}) {
+		t.Errorf("Expected published: %v\nActual: %v\n", []string{"blah"}, broker.published)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Redirects hand their hits to a HitRecorder rather than waiting on Redis.
+// Hits queue up in a bounded channel and worker goroutines write them out
+// in batches, whenever a batch fills up or the flush interval passes.  When
+// the queue is full hits are dropped, so a struggling Redis never holds up
+// a redirect, and the drops are counted.
+
+// Times a batch is tried before its hits are given up on
+const maxRecordAttempts = 3
+
+// Flush interval used when none is given, time.NewTicker panics without
+const defaultRecorderInterval = time.Second
+
+type RecorderOptions struct {
+	Workers   int
+	QueueSize int
+	BatchSize int
+	Interval  time.Duration
+}
+
+type RecorderStats struct {
+	// Hits written to the datastore
+	Recorded uint64
+	// Hits turned away because the queue was full, or abandoned unwritten
+	// when stopping
+	Dropped uint64
+	// Hits given up on after maxRecordAttempts failed writes
+	Failed uint64
+	// Batches written, successfully or not
+	Batches uint64
+}
+
+type HitRecorder struct {
+	store   Datastore
+	options RecorderOptions
+	hits    chan Hit
+	stats   RecorderStats
+
+	// Guards hits against sends after Close
+	mu      sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+
+	// Set by Abandon, 1 once queued hits are no longer written
+	abandoned int32
+}
+
+func NewHitRecorder(store Datastore, options RecorderOptions) *HitRecorder {
+	if options.Workers < 1 {
+		options.Workers = 1
+	}
+	if options.BatchSize < 1 {
+		options.BatchSize = 1
+	}
+	if options.Interval <= 0 {
+		options.Interval = defaultRecorderInterval
+	}
+
+	h := &HitRecorder{store: store, options: options, hits: make(chan Hit, options.QueueSize)}
+	for i := 0; i < options.Workers; i++ {
+		h.workers.Add(1)
+		go h.work()
+	}
+	return h
+}
+
+// Record queues a hit without blocking, returning false if it was dropped
+// because the queue is full or the recorder closed
+func (h *HitRecorder) Record(hit Hit) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.closed {
+		atomic.AddUint64(&h.stats.Dropped, 1)
+		return false
+	}
+
+	select {
+	case h.hits <- hit:
+		return true
+	default:
+		atomic.AddUint64(&h.stats.Dropped, 1)
+		return false
+	}
+}
+
+// Close stops accepting hits and waits for the workers to flush everything
+// already queued
+func (h *HitRecorder) Close() {
+	h.mu.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.hits)
+	}
+	h.mu.Unlock()
+	h.workers.Wait()
+}
+
+// Abandon makes the workers drop every hit not yet being written, so a
+// Close in progress returns as soon as the writes under way finish
+func (h *HitRecorder) Abandon() {
+	atomic.StoreInt32(&h.abandoned, 1)
+}
+
+// Queued is how many hits are waiting for a worker
+func (h *HitRecorder) Queued() int {
+	return len(h.hits)
+}
+
+// Snapshot safe to read while hits are being recorded
+func (h *HitRecorder) Stats() RecorderStats {
+	return RecorderStats{
+		Recorded: atomic.LoadUint64(&h.stats.Recorded),
+		Dropped:  atomic.LoadUint64(&h.stats.Dropped),
+		Failed:   atomic.LoadUint64(&h.stats.Failed),
+		Batches:  atomic.LoadUint64(&h.stats.Batches),
+	}
+}
+
+func (h *HitRecorder) work() {
+	defer h.workers.Done()
+	ticker := time.NewTicker(h.options.Interval)
+	defer ticker.Stop()
+
+	batch := make([]Hit, 0, h.options.BatchSize)
+	attempts := 0
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		if atomic.LoadInt32(&h.abandoned) == 1 {
+			atomic.AddUint64(&h.stats.Dropped, uint64(len(batch)))
+			batch, attempts = batch[:0], 0
+			return
+		}
+
+		atomic.AddUint64(&h.stats.Batches, 1)
+		err := h.store.RecordHits(batch)
+		if err == nil {
+			atomic.AddUint64(&h.stats.Recorded, uint64(len(batch)))
+			batch, attempts = batch[:0], 0
+			return
+		}
+
+		// Failed hits stay in the batch for the next flush, until they have
+		// had all their attempts
+		attempts++
+		log.Printf("Could not record %d hits (attempt %d): %s", len(batch), attempts, err.Error())
+		if attempts >= maxRecordAttempts {
+			atomic.AddUint64(&h.stats.Failed, uint64(len(batch)))
+			batch, attempts = batch[:0], 0
+		}
+	}
+
+	for {
+		select {
+		case hit, ok := <-h.hits:
+			if !ok {
+				// Closing gets one last try, however many attempts are left
+				attempts = maxRecordAttempts - 1
+				flush()
+				return
+			}
+
+			// After a failure, wait for the ticker to retry rather than
+			// trying again with every hit
+			batch = append(batch, hit)
+			if len(batch) >= h.options.BatchSize && attempts == 0 {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Hands a hit to the Recorder, or without one writes it straight away
+func (s *Server) recordHit(short_url string, visit Visit) {
+	hit := Hit{Code: short_url, Visit: visit, Time: s.Clock.UTCNow()}
+	if s.Recorder != nil {
+		s.Recorder.Record(hit)
+		return
+	}
+
+	if err := s.Redis.RecordHits([]Hit{hit}); err != nil {
+		log.Printf("Could not record hit on %s: %s", short_url, err.Error())
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Datastore recording the batches it is given, failing the first failures
+// of them (all of them if negative), and once started waiting on release
+// before each one
+type MockRecordingStore struct {
+	Datastore
+	mu       sync.Mutex
+	batches  [][]Hit
+	failures int
+	started  chan bool
+	release  chan bool
+}
+
+var RecordFailed = errors.New("Could not record")
+
+func (m *MockRecordingStore) RecordHits(hits []Hit) error {
+	if m.started != nil {
+		m.started <- true
+		<-m.release
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.batches = append(m.batches, append([]Hit(nil), hits...))
+	if m.failures != 0 {
+		m.failures--
+		return RecordFailed
+	}
+	return nil
+}
+
+func batchSizes(batches [][]Hit) []int {
+	sizes := make([]int, len(batches))
+	for i, batch := range batches {
+		sizes[i] = len(batch)
+	}
+	return sizes
+}
+
+func testHit(code string) Hit {
+	return Hit{Code: code, Visit: Visit{Visitor: "alice"}, Time: MockNow}
+}
+
+func TestHitRecorderBatches(t *testing.T) {
+	store := &MockRecordingStore{}
+	recorder := NewHitRecorder(store, RecorderOptions{Workers: 1, QueueSize: 10, BatchSize: 3, Interval: time.Hour})
+	for i := 0; i < 7; i++ {
+		recorder.Record(testHit("blah"))
+	}
+	recorder.Close()
+
+	// Full batches go as soon as they fill up, the rest on Close
+	if sizes := batchSizes(store.batches); !reflect.DeepEqual(sizes, []int{3, 3, 1}) {
+		t.Errorf("Expected: %v\nActual: %v", []int{3, 3, 1}, sizes)
+	}
+
+	expected := RecorderStats{Recorded: 7, Batches: 3}
+	if actual := recorder.Stats(); actual != expected {
+		t.Errorf("Expected: %+v\nActual: %+v", expected, actual)
+	}
+
+	if recorder.Record(testHit("blah")) {
+		t.Errorf("Expected hits to be dropped once closed")
+	}
+}
+
+func TestHitRecorderInterval(t *testing.T) {
+	store := &MockRecordingStore{}
+	recorder := NewHitRecorder(store, RecorderOptions{Workers: 1, QueueSize: 10, BatchSize: 100, Interval: time.Millisecond})
+	recorder.Record(testHit("blah"))
+
+	for i := 0; i < 1000 && recorder.Stats().Recorded == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if recorded := recorder.Stats().Recorded; recorded != 1 {
+		t.Errorf("Expected a partial batch to be flushed on the interval, recorded %d", recorded)
+	}
+	recorder.Close()
+}
+
+func TestHitRecorderDrops(t *testing.T) {
+	store := &MockRecordingStore{started: make(chan bool), release: make(chan bool)}
+	recorder := NewHitRecorder(store, RecorderOptions{Workers: 1, QueueSize: 2, BatchSize: 1, Interval: time.Hour})
+
+	// With the worker stuck on the first hit, two more fill the queue
+	recorder.Record(testHit("blah"))
+	<-store.started
+	for i := 0; i < 2; i++ {
+		if !recorder.Record(testHit("blah")) {
+			t.Errorf("Hit %d dropped with room in the queue", i+2)
+		}
+	}
+
+	if recorder.Record(testHit("blah")) {
+		t.Errorf("Expected a hit to be dropped with the queue full")
+	}
+
+	if queued := recorder.Queued(); queued != 2 {
+		t.Errorf("Expected %d queued, actual %d", 2, queued)
+	}
+
+	go func() {
+		for range store.started {
+			store.release <- true
+		}
+	}()
+	store.release <- true
+	recorder.Close()
+	close(store.started)
+
+	expected := RecorderStats{Recorded: 3, Dropped: 1, Batches: 3}
+	if actual := recorder.Stats(); actual != expected {
+		t.Errorf("Expected: %+v\nActual: %+v", expected, actual)
+	}
+}
+
+func TestHitRecorderRetries(t *testing.T) {
+	// A failed batch is tried again, here on Close
+	store := &MockRecordingStore{failures: 1}
+	recorder := NewHitRecorder(store, RecorderOptions{Workers: 1, QueueSize: 10, BatchSize: 1, Interval: time.Hour})
+	recorder.Record(testHit("blah"))
+	recorder.Close()
+
+	if sizes := batchSizes(store.batches); !reflect.DeepEqual(sizes, []int{1, 1}) {
+		t.Errorf("Expected: %v\nActual: %v", []int{1, 1}, sizes)
+	}
+
+	expected := RecorderStats{Recorded: 1, Batches: 2}
+	if actual := recorder.Stats(); actual != expected {
+		t.Errorf("Expected: %+v\nActual: %+v", expected, actual)
+	}
+
+	// Hits that never make it are counted as failed
+	store = &MockRecordingStore{failures: -1}
+	recorder = NewHitRecorder(store, RecorderOptions{Workers: 1, QueueSize: 10, BatchSize: 1, Interval: time.Hour})
+	recorder.Record(testHit("blah"))
+	recorder.Close()
+
+	expected = RecorderStats{Failed: 1, Batches: 2}
+	if actual := recorder.Stats(); actual != expected {
+		t.Errorf("Expected: %+v\nActual: %+v", expected, actual)
+	}
+}
+
+func TestHitRecorderDefaults(t *testing.T) {
+	// Options out of range are clamped rather than panicking in a worker
+	store := &MockRecordingStore{}
+	recorder := NewHitRecorder(store, RecorderOptions{QueueSize: 10})
+	recorder.Record(testHit("blah"))
+	recorder.Close()
+
+	if sizes := batchSizes(store.batches); !reflect.DeepEqual(sizes, []int{1}) {
+		t.Errorf("Expected: %v\nActual: %v", []int{1}, sizes)
+	}
+
+	expected := RecorderOptions{Workers: 1, QueueSize: 10, BatchSize: 1, Interval: defaultRecorderInterval}
+	if recorder.options != expected {
+		t.Errorf("Expected: %+v\nActual: %+v", expected, recorder.options)
+	}
+}
+
+func TestHitRecorderAbandon(t *testing.T) {
+	store := &MockRecordingStore{started: make(chan bool), release: make(chan bool)}
+	recorder := NewHitRecorder(store, RecorderOptions{Workers: 1, QueueSize: 10, BatchSize: 1, Interval: time.Hour})
+	for i := 0; i < 3; i++ {
+		recorder.Record(testHit("blah"))
+	}
+
+	closed := make(chan bool)
+	go func() {
+		recorder.Close()
+		close(closed)
+	}()
+
+	// The batch being written finishes, the rest is dropped unwritten
+	<-store.started
+	recorder.Abandon()
+	store.release <- true
+	<-closed
+
+	expected := RecorderStats{Recorded: 1, Dropped: 2, Batches: 1}
+	if actual := recorder.Stats(); actual != expected {
+		t.Errorf("Expected: %+v\nActual: %+v", expected, actual)
+	}
+}
+
+func TestRecordHitWithRecorder(t *testing.T) {
+	server := NewMockServer()
+	server.Recorder = NewHitRecorder(server.Redis, RecorderOptions{Workers: 1, QueueSize: 10, BatchSize: 10, Interval: time.Hour})
+	server.recordHit("baz", Visit{Visitor: "alice"})
+
+	// Nothing is written until the batch is flushed
+	if hits, err := server.Redis.GetHits("baz"); err != NilValue {
+		t.Errorf("Expected no hits yet\nActual: %+v, %v", hits, err)
+	}
+
+	server.Recorder.Close()
+	if hits, _ := server.Redis.GetHits("baz"); hits.Count != 1 {
+		t.Errorf("Expected: %d\nActual: %d", 1, hits.Count)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// On SIGINT or SIGTERM the server stops accepting connections and lets
+// requests in flight finish, within the shutdown timeout.  It then stops
+// the background jobs, writes out queued hits within a budget of their own,
+// the flush timeout, and closes the datastore.
+
+// Timeouts keep slow or idle clients from holding connections forever
+func newHTTPServer(config ServerConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(config.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(config.ReadTimeout),
+		WriteTimeout:      time.Duration(config.WriteTimeout),
+		IdleTimeout:       time.Duration(config.IdleTimeout),
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+}
+
+// An http.Server and the listener it serves on
+type endpoint struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// Serves every endpoint until a signal arrives or one of them fails, then
+// shuts them down within timeout and server within flushTimeout
+func serveUntilSignal(endpoints []endpoint, server Server, timeout, flushTimeout time.Duration, signals <-chan os.Signal) error {
+	served := make(chan error, len(endpoints))
+	for _, e := range endpoints {
+		go func(e endpoint) {
+			served <- e.server.Serve(e.listener)
+		}(e)
+	}
+
+	var err error
+	select {
+	case err = <-served:
+		log.Printf("Stopped serving: %s", err.Error())
+	case received := <-signals:
+		log.Printf("Received %s, shutting down", received)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, e := range endpoints {
+		if shutdownErr := e.server.Shutdown(ctx); shutdownErr != nil {
+			log.Printf("Requests still running after %v, closing their connections", timeout)
+			e.server.Close()
+		}
+	}
+
+	// Slow requests must not eat into the time left for queued hits
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer flushCancel()
+	if closeErr := server.Close(flushCtx); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Close stops compaction and invalidation, flushes the Recorder and closes
+// the datastore.  Queued hits are abandoned once ctx is done, but writes
+// already under way are waited for so none is cut off by the close.
+func (s Server) Close(ctx context.Context) error {
+	close(s.stop)
+	if s.Invalidator != nil {
+		s.Invalidator.Close()
+	}
+
+	if s.Recorder != nil {
+		log.Printf("Flushing %d queued hits", s.Recorder.Queued())
+		flushed := make(chan struct{})
+		go func() {
+			s.Recorder.Close()
+			close(flushed)
+		}()
+
+		select {
+		case <-flushed:
+		case <-ctx.Done():
+			log.Printf("Gave up on %d queued hits", s.Recorder.Queued())
+			s.Recorder.Abandon()
+			<-flushed
+		}
+	}
+
+	return s.Redis.Close()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Datastore noting whether it was closed while hits were being written,
+// which wait on release when it is set
+type MockClosingStore struct {
+	Datastore
+	closed          bool
+	release         chan bool
+	recording       int32
+	closedRecording bool
+}
+
+func (m *MockClosingStore) RecordHits(hits []Hit) error {
+	atomic.AddInt32(&m.recording, 1)
+	defer atomic.AddInt32(&m.recording, -1)
+	if m.release != nil {
+		<-m.release
+	}
+	return m.Datastore.RecordHits(hits)
+}
+
+func (m *MockClosingStore) Close() error {
+	m.closed = true
+	m.closedRecording = atomic.LoadInt32(&m.recording) != 0
+	return nil
+}
+
+func testShutdown(t *testing.T, handler http.HandlerFunc, timeout, flushTimeout time.Duration, release chan bool) (Server, *MockClosingStore, chan os.Signal, chan error, string) {
+	mockStore, _ := CreateMockStore()
+	store := &MockClosingStore{Datastore: mockStore, release: release}
+	server := NewServer(store, mockStore.Clock)
+	server.Recorder = NewHitRecorder(store, RecorderOptions{Workers: 1, QueueSize: 10, BatchSize: 10, Interval: time.Hour})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	stopped := make(chan error, 1)
+	httpServer := newHTTPServer(DefaultConfig().Server, handler)
+	go func() {
+		stopped <- serveUntilSignal([]endpoint{{httpServer, listener}}, server, timeout, flushTimeout, signals)
+	}()
+	return server, store, signals, stopped, "http://" + listener.Addr().String()
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	started, release := make(chan bool), make(chan bool)
+	var server Server
+	server, store, signals, stopped, url := testShutdown(t, func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+		server.recordHit("baz", Visit{Visitor: "alice"})
+		w.Write([]byte("done"))
+	}, time.Minute, time.Minute, nil)
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		response, err := http.Get(url)
+		if err != nil {
+			t.Errorf("Request in flight failed: %s", err)
+		}
+		responses <- response
+	}()
+
+	// The request in flight is allowed to finish after the signal
+	<-started
+	signals <- syscall.SIGTERM
+	time.Sleep(10 * time.Millisecond)
+	release <- true
+
+	if response := <-responses; response == nil || response.StatusCode != 200 {
+		t.Errorf("Expected the request in flight to succeed\nActual: %v", response)
+	}
+
+	if err := <-stopped; err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	if !store.closed {
+		t.Errorf("Expected the datastore to be closed")
+	}
+
+	// Its hit was still queued when the request finished
+	if hits, _ := store.GetHits("baz"); hits.Count != 1 {
+		t.Errorf("Expected: %d\nActual: %d", 1, hits.Count)
+	}
+
+	if _, err := http.Get(url); err == nil {
+		t.Errorf("Expected no new connections to be accepted")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started, release := make(chan bool), make(chan bool)
+	defer close(release)
+	_, store, signals, stopped, url := testShutdown(t, func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+	}, 10*time.Millisecond, time.Minute, nil)
+
+	go http.Get(url)
+	<-started
+	signals <- syscall.SIGINT
+
+	// A stuck request does not hold up the shutdown past the deadline
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Shutdown did not finish")
+	}
+
+	if !store.closed {
+		t.Errorf("Expected the datastore to be closed")
+	}
+}
+
+func TestFlushTimeout(t *testing.T) {
+	release := make(chan bool)
+	server, store, signals, stopped, _ := testShutdown(t, func(w http.ResponseWriter, r *http.Request) {}, time.Minute, 10*time.Millisecond, release)
+	server.recordHit("baz", Visit{Visitor: "alice"})
+	signals <- syscall.SIGTERM
+
+	// The datastore is not closed under a write already under way
+	select {
+	case <-stopped:
+		t.Fatalf("Shutdown finished while hits were being written")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- true
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Shutdown did not finish")
+	}
+
+	if !store.closed || store.closedRecording {
+		t.Errorf("Expected the datastore to be closed once the write finished\nActual: %+v", store)
+	}
+}
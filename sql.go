@@ -0,0 +1,949 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// SQLStore keeps links and hits in PostgreSQL or SQLite, so they can be
+// reported on with plain SQL.  Links are rows of the links table and hits
+// are counted per link and hour, day or month in the hits table, with
+// breakdowns and visitors in tables of their own, see migrations/.  Unique
+// visitors are counted exactly, like MemoryClient does.
+//
+// The same queries serve both databases: they are written with ?
+// placeholders, numbered for PostgreSQL by rebind, and only use what both
+// understand, like INSERT ... ON CONFLICT.
+
+type SQLStore struct {
+	db     *sql.DB
+	driver string
+	Clock
+}
+
+// OpenSQLStore connects with a database/sql driver, "postgres" or
+// "sqlite", and brings the schema up to date.  SQLite only has one writer
+// at a time anyway, so it gets a single connection and queries wait their
+// turn rather than fail with SQLITE_BUSY.
+func OpenSQLStore(driver, source string, clock Clock) (SQLStore, error) {
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		return SQLStore{}, err
+	}
+	if driver == "sqlite" {
+		db.SetMaxOpenConns(1)
+	}
+
+	store := SQLStore{db, driver, clock}
+	if err := store.migrate(); err != nil {
+		db.Close()
+		return SQLStore{}, err
+	}
+	return store, nil
+}
+
+//
+// Migrations -- numbered files of statements, applied in order once each
+//
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	Version    int
+	Name       string
+	Statements string
+}
+
+// The embedded migrations sorted by version, the number their file name
+// starts with, as in 2_hits.sql
+func loadMigrations() ([]migration, error) {
+	files, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]migration, 0, len(files))
+	for _, file := range files {
+		version, err := strconv.Atoi(strings.SplitN(file.Name(), "_", 2)[0])
+		if err != nil {
+			return nil, fmt.Errorf("Migration %s is not numbered", file.Name())
+		}
+
+		statements, err := migrationFiles.ReadFile("migrations/" + file.Name())
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version, file.Name(), string(statements)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Any number PostgreSQL advisory locks on this database do not otherwise use
+const migrationLock = 0x73686f72
+
+// Applies the migrations newer than the last one recorded in
+// schema_migrations, all in one transaction along with their records, so a
+// failed one leaves the schema as it was to be fixed and retried.  On
+// PostgreSQL instances starting together take turns holding an advisory
+// lock, the later ones finding nothing left to apply.
+func (s SQLStore) migrate() error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	var applied []string
+	err = s.inTx(func(tx *sql.Tx) error {
+		if s.driver == "postgres" {
+			if _, err := tx.Exec(s.rebind(`SELECT pg_advisory_xact_lock(?)`), migrationLock); err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at TIMESTAMP NOT NULL)`)
+		if err != nil {
+			return err
+		}
+
+		var current int
+		err = tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if m.Version <= current {
+				continue
+			}
+
+			if _, err := tx.Exec(m.Statements); err != nil {
+				return fmt.Errorf("Migration %s failed: %s", m.Name, err)
+			}
+			_, err := tx.Exec(s.rebind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`), m.Version, sqlTime(s.UTCNow()))
+			if err != nil {
+				return err
+			}
+			applied = append(applied, m.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range applied {
+		log.Printf("Applied migration %s", name)
+	}
+	return nil
+}
+
+//
+// Helpers
+//
+
+// Numbers the ? placeholders of query as $1, $2... for PostgreSQL.  No query
+// here has a literal question mark.
+func (s SQLStore) rebind(query string) string {
+	if s.driver != "postgres" {
+		return query
+	}
+
+	var numbered strings.Builder
+	n := 0
+	for _, c := range query {
+		if c != '?' {
+			numbered.WriteRune(c)
+			continue
+		}
+		n++
+		numbered.WriteString("$" + strconv.Itoa(n))
+	}
+	return numbered.String()
+}
+
+// Runs fn in a transaction, committed if fn succeeds and rolled back if not
+func (s SQLStore) inTx(fn func(*sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Times are stored in UTC to the second.  SQLite keeps them as text, which
+// only sorts in time order when every value has the same form.
+func sqlTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func startOfMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Ping checks the database can be reached
+func (s SQLStore) Ping() error {
+	return s.db.Ping()
+}
+
+// Close releases the connections, the store cannot be used afterwards
+func (s SQLStore) Close() error {
+	return s.db.Close()
+}
+
+//
+// Links
+//
+
+type linkRow struct {
+	Url       string
+	Created   time.Time
+	ExpiresAt sql.NullTime
+}
+
+func (l linkRow) expired(now time.Time) bool {
+	return l.ExpiresAt.Valid && !l.ExpiresAt.Time.After(now)
+}
+
+// The row of code, NilValue if there is none, expired or not
+func (s SQLStore) getLinkRow(code string) (linkRow, error) {
+	var row linkRow
+	err := s.db.QueryRow(s.rebind(`SELECT url, created_at, expires_at FROM links WHERE code = ?`), code).
+		Scan(&row.Url, &row.Created, &row.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return row, NilValue
+	}
+	return row, err
+}
+
+// GetURL returns LinkExpired rather than NilValue for links whose expiry
+// has passed, like RedisStore.GetURL
+func (s SQLStore) GetURL(code string) (string, error) {
+	row, err := s.getLinkRow(code)
+	if err != nil {
+		return "", err
+	}
+
+	if row.expired(s.UTCNow()) {
+		return "", LinkExpired
+	}
+	return row.Url, nil
+}
+
+// SaveURL claims the first free code in the salted hash sequence of
+// long_url, like RedisStore.SaveURL
+func (s SQLStore) SaveURL(long_url string, expiresAt time.Time) (string, bool, error) {
+	for attempt := 0; attempt < maxHashAttempts; attempt++ {
+		code := saltedHashUrl(long_url, attempt)
+		created, err := s.claimURL(code, long_url, expiresAt)
+		if err != nil {
+			return "", false, err
+		}
+
+		if created {
+			return code, true, nil
+		}
+
+		same, err := s.holdsURL(code, long_url, expiresAt)
+		if err != nil {
+			return "", false, err
+		}
+
+		if same {
+			return code, false, nil
+		}
+	}
+
+	return "", false, HashCollision
+}
+
+func (s SQLStore) SaveAlias(alias, long_url string, expiresAt time.Time) (bool, error) {
+	created, err := s.claimURL(alias, long_url, expiresAt)
+	if err != nil || created {
+		return created, err
+	}
+
+	same, err := s.holdsURL(alias, long_url, expiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	if !same {
+		return false, AliasTaken
+	}
+
+	return false, nil
+}
+
+// Inserts the link unless its code already has a row.  Expired links keep
+// theirs until deleted, so their code is never handed to another url.
+func (s SQLStore) claimURL(code, long_url string, expiresAt time.Time) (bool, error) {
+	var expires sql.NullTime
+	if !expiresAt.IsZero() {
+		if !expiresAt.After(s.UTCNow()) {
+			return false, LinkExpired
+		}
+		expires = sql.NullTime{Time: sqlTime(expiresAt), Valid: true}
+	}
+
+	result, err := s.db.Exec(s.rebind(`INSERT INTO links (code, url, created_at, expires_at) VALUES (?, ?, ?, ?) ON CONFLICT (code) DO NOTHING`),
+		code, long_url, sqlTime(s.UTCNow()), expires)
+	if err != nil {
+		return false, err
+	}
+
+	inserted, err := result.RowsAffected()
+	return inserted == 1, err
+}
+
+func (s SQLStore) holdsURL(code, long_url string, expiresAt time.Time) (bool, error) {
+	row, err := s.getLinkRow(code)
+	if err == NilValue {
+		return false, nil
+	}
+
+	if err != nil || row.Url != long_url || row.expired(s.UTCNow()) {
+		return false, err
+	}
+
+	var existingExpiry time.Time
+	if row.ExpiresAt.Valid {
+		existingExpiry = row.ExpiresAt.Time
+	}
+	return existingExpiry.Equal(expiresAt.Truncate(time.Second)), nil
+}
+
+// Hits by people over all time, hours being counted in their day already
+func (s SQLStore) countHits(code string) (int, error) {
+	var count int
+	err := s.db.QueryRow(s.rebind(`SELECT COALESCE(SUM(people), 0) FROM hits WHERE code = ? AND period <> 'hour'`), code).Scan(&count)
+	return count, err
+}
+
+func (s SQLStore) GetLink(code string) (Link, error) {
+	row, err := s.getLinkRow(code)
+	if err != nil {
+		return Link{}, err
+	}
+
+	if row.expired(s.UTCNow()) {
+		return Link{}, LinkExpired
+	}
+
+	link := row.link(code)
+	link.Hits, err = s.countHits(code)
+	if err != nil {
+		return Link{}, err
+	}
+	return link, nil
+}
+
+// GetTarget is GetLink without counting hits, for redirects
+func (s SQLStore) GetTarget(code string) (Link, error) {
+	row, err := s.getLinkRow(code)
+	if err != nil {
+		return Link{}, err
+	}
+
+	if row.expired(s.UTCNow()) {
+		return Link{}, LinkExpired
+	}
+	return row.link(code), nil
+}
+
+func (l linkRow) link(code string) Link {
+	created := l.Created.UTC()
+	link := Link{Code: code, Url: l.Url, Created: &created}
+	if l.ExpiresAt.Valid {
+		expiresAt := l.ExpiresAt.Time.UTC()
+		link.ExpiresAt = &expiresAt
+	}
+	return link
+}
+
+// UpdateURL points an existing link at long_url, keeping its code, expiry
+// and hits
+func (s SQLStore) UpdateURL(code, long_url string) error {
+	row, err := s.getLinkRow(code)
+	if err != nil {
+		return err
+	}
+
+	if row.expired(s.UTCNow()) {
+		return LinkExpired
+	}
+
+	result, err := s.db.Exec(s.rebind(`UPDATE links SET url = ? WHERE code = ?`), long_url, code)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	// Deleted since it was read
+	if updated == 0 {
+		return NilValue
+	}
+	return nil
+}
+
+// DeleteURL removes a link along with its hits, freeing the code for reuse.
+// Expired links can be deleted too.
+func (s SQLStore) DeleteURL(code string) error {
+	var deleted int64
+	err := s.inTx(func(tx *sql.Tx) error {
+		for _, table := range []string{"links", "hits", "breakdowns", "visitors", "daily_visitors"} {
+			result, err := tx.Exec(s.rebind(`DELETE FROM `+table+` WHERE code = ?`), code)
+			if err != nil {
+				return err
+			}
+
+			rows, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			deleted += rows
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return NilValue
+	}
+	return nil
+}
+
+// ListURLs returns up to limit links ordered by code, starting after the code
+// given as cursor, along with the cursor for the next page ("" on the last
+// page).  Expired links are left out.
+func (s SQLStore) ListURLs(cursor string, limit int) ([]Link, string, error) {
+	rows, err := s.db.Query(s.rebind(`
+		SELECT code, url, created_at, expires_at,
+			(SELECT COALESCE(SUM(people), 0) FROM hits WHERE hits.code = links.code AND period <> 'hour')
+		FROM links
+		WHERE code > ? AND (expires_at IS NULL OR expires_at > ?)
+		ORDER BY code
+		LIMIT ?`), cursor, sqlTime(s.UTCNow()), limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	links := make([]Link, 0, limit)
+	for rows.Next() {
+		if len(links) == limit {
+			// There is at least one more
+			return links, links[limit-1].Code, nil
+		}
+
+		var code string
+		var row linkRow
+		var hits int
+		if err := rows.Scan(&code, &row.Url, &row.Created, &row.ExpiresAt, &hits); err != nil {
+			return nil, "", err
+		}
+
+		link := row.link(code)
+		link.Hits = hits
+		links = append(links, link)
+	}
+	return links, "", rows.Err()
+}
+
+//
+// Hits
+//
+
+// What breakdowns rows count hits by, in the order of Visit's fields.  Bots
+// are counted by what they were taken for as "bot".
+var breakdownKinds = []string{"referrer", "browser", "os", "device", "country", "city"}
+
+// GetHits puts the hits of code together like RedisStore.GetHits, returning
+// NilValue if there are none at all
+func (s SQLStore) GetHits(code string) (Hits, error) {
+	result := NewHits()
+	found, err := s.getPeriods(code, &result)
+	if err != nil {
+		return NewHits(), err
+	}
+
+	if !found {
+		return NewHits(), NilValue
+	}
+
+	if err := s.getVisitors(code, &result); err != nil {
+		return NewHits(), err
+	}
+
+	if err := s.getBreakdowns(code, &result); err != nil {
+		return NewHits(), err
+	}
+	return result, nil
+}
+
+// Fills in the counts from the hits rows of code, and whether it has any
+func (s SQLStore) getPeriods(code string, hits *Hits) (bool, error) {
+	rows, err := s.db.Query(s.rebind(`SELECT period, started_at, people, bots FROM hits WHERE code = ?`), code)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	found := false
+	for rows.Next() {
+		found = true
+		var period string
+		var start time.Time
+		var people, bots int
+		if err := rows.Scan(&period, &start, &people, &bots); err != nil {
+			return false, err
+		}
+		start = start.UTC()
+
+		switch period {
+		case "hour":
+			if hits.Hours == nil {
+				hits.Hours = make(map[time.Time]int)
+			}
+			hits.Hours[start] += people
+			continue
+		case "day":
+			if people > 0 {
+				hits.Days[start] += people
+			}
+			if bots > 0 {
+				if hits.BotDays == nil {
+					hits.BotDays = make(map[time.Time]int)
+				}
+				hits.BotDays[start] += bots
+			}
+		case "month":
+			if people > 0 {
+				if hits.Months == nil {
+					hits.Months = make(map[time.Time]int)
+				}
+				hits.Months[start] += people
+			}
+		}
+
+		hits.Count += people
+		hits.Bots += bots
+	}
+	return found, rows.Err()
+}
+
+// Distinct visitors for all time, and per day for the days in hits.Days
+func (s SQLStore) getVisitors(code string, hits *Hits) error {
+	err := s.db.QueryRow(s.rebind(`SELECT COUNT(*) FROM visitors WHERE code = ?`), code).Scan(&hits.Unique)
+	if err != nil {
+		return err
+	}
+
+	rows, err := s.db.Query(s.rebind(`SELECT day, COUNT(*) FROM daily_visitors WHERE code = ? GROUP BY day`), code)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var day time.Time
+		var count int
+		if err := rows.Scan(&day, &count); err != nil {
+			return err
+		}
+
+		day = day.UTC()
+		if _, present := hits.Days[day]; !present {
+			continue
+		}
+
+		if hits.UniqueDays == nil {
+			hits.UniqueDays = make(map[time.Time]int)
+		}
+		hits.UniqueDays[day] = count
+	}
+	return rows.Err()
+}
+
+// The top breakdownSize of each breakdown, most hits first and ties in
+// reverse order like RedisStore
+func (s SQLStore) getBreakdowns(code string, hits *Hits) error {
+	rows, err := s.db.Query(s.rebind(`SELECT kind, value, hits FROM breakdowns WHERE code = ? ORDER BY kind, hits DESC, value DESC`), code)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tops := make(map[string][]Tally)
+	for rows.Next() {
+		var kind string
+		var tally Tally
+		if err := rows.Scan(&kind, &tally.Name, &tally.Hits); err != nil {
+			return err
+		}
+
+		if len(tops[kind]) < breakdownSize {
+			tops[kind] = append(tops[kind], tally)
+		}
+	}
+
+	hits.Referrers, hits.Browsers, hits.OS = tops["referrer"], tops["browser"], tops["os"]
+	hits.Devices, hits.Countries, hits.Cities = tops["device"], tops["country"], tops["city"]
+	hits.BotAgents = tops["bot"]
+	return rows.Err()
+}
+
+func (s SQLStore) IncrementHits(code string, visit Visit) error {
+	return s.RecordHits([]Hit{{Code: code, Visit: visit, Time: s.UTCNow()}})
+}
+
+type periodKey struct {
+	Code   string
+	Period string
+	Start  time.Time
+}
+
+type breakdownKey struct {
+	Code  string
+	Kind  string
+	Value string
+}
+
+// Visitors of a link on Day, or for all time with a zero Day
+type visitorKey struct {
+	Code    string
+	Day     time.Time
+	Visitor string
+}
+
+// RecordHits sums the hits up per row and adds them in one transaction.
+// Rows are written in a fixed order so that concurrent batches on PostgreSQL
+// wait for each other instead of deadlocking.
+func (s SQLStore) RecordHits(hits []Hit) error {
+	if len(hits) == 0 {
+		return nil
+	}
+
+	people := make(map[periodKey]int64)
+	bots := make(map[periodKey]int64)
+	breakdowns := make(map[breakdownKey]int64)
+	visitors := make(map[visitorKey]bool)
+	for _, hit := range hits {
+		day := periodKey{hit.Code, "day", startOfDay(hit.Time)}
+		if hit.Visit.Bot != "" {
+			bots[day]++
+			breakdowns[breakdownKey{hit.Code, "bot", hit.Visit.Bot}]++
+			continue
+		}
+
+		people[day]++
+		people[periodKey{hit.Code, "hour", hit.Time.UTC().Truncate(time.Hour)}]++
+		visitors[visitorKey{hit.Code, time.Time{}, hit.Visit.Visitor}] = true
+		visitors[visitorKey{hit.Code, day.Start, hit.Visit.Visitor}] = true
+
+		visit := hit.Visit
+		for i, value := range []string{visit.Referrer, visit.Browser, visit.OS, visit.Device, visit.Country, visit.City} {
+			if value != "" {
+				breakdowns[breakdownKey{hit.Code, breakdownKinds[i], value}]++
+			}
+		}
+	}
+
+	periods := make([]periodKey, 0, len(people)+len(bots))
+	for key := range people {
+		periods = append(periods, key)
+	}
+	for key := range bots {
+		if _, present := people[key]; !present {
+			periods = append(periods, key)
+		}
+	}
+	sort.Slice(periods, func(i, j int) bool {
+		a, b := periods[i], periods[j]
+		if a.Code != b.Code {
+			return a.Code < b.Code
+		}
+		if a.Period != b.Period {
+			return a.Period < b.Period
+		}
+		return a.Start.Before(b.Start)
+	})
+
+	kinds := make([]breakdownKey, 0, len(breakdowns))
+	for key := range breakdowns {
+		kinds = append(kinds, key)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		a, b := kinds[i], kinds[j]
+		return a.Code+"\x00"+a.Kind+"\x00"+a.Value < b.Code+"\x00"+b.Kind+"\x00"+b.Value
+	})
+
+	seen := make([]visitorKey, 0, len(visitors))
+	for key := range visitors {
+		seen = append(seen, key)
+	}
+	sort.Slice(seen, func(i, j int) bool {
+		a, b := seen[i], seen[j]
+		if a.Code != b.Code {
+			return a.Code < b.Code
+		}
+		if !a.Day.Equal(b.Day) {
+			return a.Day.Before(b.Day)
+		}
+		return a.Visitor < b.Visitor
+	})
+
+	return s.inTx(func(tx *sql.Tx) error {
+		for _, key := range periods {
+			if err := s.addHits(tx, key, people[key], bots[key]); err != nil {
+				return err
+			}
+		}
+
+		for _, key := range kinds {
+			_, err := tx.Exec(s.rebind(`
+				INSERT INTO breakdowns (code, kind, value, hits) VALUES (?, ?, ?, ?)
+				ON CONFLICT (code, kind, value) DO UPDATE SET hits = breakdowns.hits + excluded.hits`),
+				key.Code, key.Kind, key.Value, breakdowns[key])
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, key := range seen {
+			var err error
+			if key.Day.IsZero() {
+				_, err = tx.Exec(s.rebind(`INSERT INTO visitors (code, visitor) VALUES (?, ?) ON CONFLICT DO NOTHING`),
+					key.Code, key.Visitor)
+			} else {
+				_, err = tx.Exec(s.rebind(`INSERT INTO daily_visitors (code, day, visitor) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`),
+					key.Code, key.Day, key.Visitor)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Adds to the hits row of key, creating it if need be
+func (s SQLStore) addHits(tx *sql.Tx, key periodKey, people, bots int64) error {
+	_, err := tx.Exec(s.rebind(`
+		INSERT INTO hits (code, period, started_at, people, bots) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (code, period, started_at) DO UPDATE SET people = hits.people + excluded.people, bots = hits.bots + excluded.bots`),
+		key.Code, key.Period, key.Start, people, bots)
+	return err
+}
+
+// TopLinks returns the limit links with the most hits by people over the
+// last days days, today included, leaving out expired links.  It ranks by
+// day rows, so days already folded into months by CompactHits no longer
+// count.
+func (s SQLStore) TopLinks(days int, limit int) ([]TopLink, error) {
+	now := s.UTCNow()
+	today := startOfDay(now)
+	rows, err := s.db.Query(s.rebind(`
+		SELECT hits.code, links.url, SUM(hits.people) AS total
+		FROM hits JOIN links ON links.code = hits.code
+		WHERE hits.period = 'day' AND hits.started_at > ? AND hits.started_at <= ?
+			AND (links.expires_at IS NULL OR links.expires_at > ?)
+		GROUP BY hits.code, links.url
+		HAVING SUM(hits.people) > 0
+		ORDER BY total DESC, hits.code DESC
+		LIMIT ?`), today.AddDate(0, 0, -days), today, sqlTime(now), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := make([]TopLink, 0, limit)
+	for rows.Next() {
+		var link TopLink
+		if err := rows.Scan(&link.Code, &link.Url, &link.Hits); err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// ClaimCompaction takes the compaction row of the locks table for
+// interval, like RedisStore.ClaimCompaction.  An expired lock is deleted
+// first, in the same transaction, so only one instance can take it over.
+func (s SQLStore) ClaimCompaction(interval time.Duration) (bool, error) {
+	now := s.UTCNow()
+	claimed := false
+	err := s.inTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(s.rebind(`DELETE FROM locks WHERE name = ? AND expires_at <= ?`), compactionLockKey, sqlTime(now))
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(s.rebind(`INSERT INTO locks (name, expires_at) VALUES (?, ?) ON CONFLICT (name) DO NOTHING`),
+			compactionLockKey, sqlTime(now.Add(interval)))
+		if err != nil {
+			return err
+		}
+
+		inserted, err := result.RowsAffected()
+		claimed = inserted == 1
+		return err
+	})
+	return claimed, err
+}
+
+// CompactHits applies policy like RedisStore.CompactHits: hour rows older
+// than policy.Hours are dropped, day rows older than policy.Days are folded
+// into their month along with dropping the daily visitors, and referrer and
+// city breakdowns are trimmed, all in one transaction.  Returns the number
+// of links whose hits changed.
+func (s SQLStore) CompactHits(policy RetentionPolicy) (int, error) {
+	now := s.UTCNow()
+	changed := make(map[string]bool)
+	err := s.inTx(func(tx *sql.Tx) error {
+		// Only periods that ended before the cutoff are touched
+		if policy.Hours > 0 {
+			cutoff := sqlTime(now.Add(-policy.Hours).Add(-time.Hour))
+			expired, err := s.queryPeriods(tx, "hour", cutoff)
+			if err != nil {
+				return err
+			}
+
+			for key := range expired {
+				changed[key.Code] = true
+			}
+
+			_, err = tx.Exec(s.rebind(`DELETE FROM hits WHERE period = 'hour' AND started_at <= ?`), cutoff)
+			if err != nil {
+				return err
+			}
+		}
+
+		if policy.Days > 0 {
+			cutoff := sqlTime(now.Add(-policy.Days).AddDate(0, 0, -1))
+			expired, err := s.queryPeriods(tx, "day", cutoff)
+			if err != nil {
+				return err
+			}
+
+			for key, counts := range expired {
+				changed[key.Code] = true
+				month := periodKey{key.Code, "month", startOfMonth(key.Start)}
+				if err := s.addHits(tx, month, counts[0], counts[1]); err != nil {
+					return err
+				}
+			}
+
+			_, err = tx.Exec(s.rebind(`DELETE FROM hits WHERE period = 'day' AND started_at <= ?`), cutoff)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(s.rebind(`DELETE FROM daily_visitors WHERE day <= ?`), cutoff)
+			if err != nil {
+				return err
+			}
+		}
+
+		return s.trimBreakdowns(tx)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(changed), nil
+}
+
+// People and bots counted in each period row started by cutoff
+func (s SQLStore) queryPeriods(tx *sql.Tx, period string, cutoff time.Time) (map[periodKey][2]int64, error) {
+	rows, err := tx.Query(s.rebind(`SELECT code, started_at, people, bots FROM hits WHERE period = ? AND started_at <= ?`), period, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	periods := make(map[periodKey][2]int64)
+	for rows.Next() {
+		key := periodKey{Period: period}
+		var people, bots int64
+		if err := rows.Scan(&key.Code, &key.Start, &people, &bots); err != nil {
+			return nil, err
+		}
+		key.Start = key.Start.UTC()
+		periods[key] = [2]int64{people, bots}
+	}
+	return periods, rows.Err()
+}
+
+// Keeps the top breakdownRetained referrers and cities of each link, the
+// breakdowns with no bound on their values
+func (s SQLStore) trimBreakdowns(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT code, kind, value FROM breakdowns WHERE kind IN ('referrer', 'city') ORDER BY code, kind, hits DESC, value DESC`)
+	if err != nil {
+		return err
+	}
+
+	var excess []breakdownKey
+	var previous breakdownKey
+	kept := 0
+	for rows.Next() {
+		var key breakdownKey
+		if err := rows.Scan(&key.Code, &key.Kind, &key.Value); err != nil {
+			rows.Close()
+			return err
+		}
+
+		if key.Code != previous.Code || key.Kind != previous.Kind {
+			kept = 0
+		}
+		previous = key
+
+		if kept < breakdownRetained {
+			kept++
+			continue
+		}
+		excess = append(excess, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, key := range excess {
+		_, err := tx.Exec(s.rebind(`DELETE FROM breakdowns WHERE code = ? AND kind = ? AND value = ?`), key.Code, key.Kind, key.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
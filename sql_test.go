@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SQL store is tested against a new SQLite file, or the database
+// SQL_TEST_STORE names like STORE would, as in
+// postgres://localhost/shortener_test?sslmode=disable
+func sqlTestSource(t *testing.T) (string, string) {
+	if driver, source, ok := SQLSource(os.Getenv("SQL_TEST_STORE")); ok {
+		return driver, source
+	}
+	return "sqlite", filepath.Join(t.TempDir(), "shortener.db")
+}
+
+// Opens the test database with its tables emptied
+func openTestSQLStore(t *testing.T, driver, source string, clock Clock) SQLStore {
+	store, err := OpenSQLStore(driver, source, clock)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, table := range []string{"links", "hits", "breakdowns", "visitors", "daily_visitors", "locks"} {
+		if _, err := store.db.Exec("DELETE FROM " + table); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	return store
+}
+
+func TestSQLStore(t *testing.T) {
+	var stores []SQLStore
+	defer func() {
+		for _, store := range stores {
+			store.Close()
+		}
+	}()
+
+	testDatastore(t, func(clock *MockClock) Datastore {
+		driver, source := sqlTestSource(t)
+		store := openTestSQLStore(t, driver, source, clock)
+		stores = append(stores, store)
+		return store
+	})
+}
+
+func TestSQLMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var expected []int
+	for i, m := range migrations {
+		if m.Version != i+1 || m.Statements == "" {
+			t.Errorf("Expected migration %d\nActual: %s", i+1, m.Name)
+		}
+		expected = append(expected, m.Version)
+	}
+
+	// Reopening applies nothing twice and keeps the data
+	clock := &MockClock{current: MockNow}
+	driver, source := sqlTestSource(t)
+	store := openTestSQLStore(t, driver, source, clock)
+	store.SaveAlias("baz", "boo.baz", time.Time{})
+	store.Close()
+
+	store, err = OpenSQLStore(driver, source, clock)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer store.Close()
+
+	if url, err := store.GetURL("baz"); err != nil || url != "boo.baz" {
+		t.Errorf("Expected: %s\nActual: %s, %v", "boo.baz", url, err)
+	}
+
+	var applied []int
+	rows, err := store.db.Query(`SELECT version FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for rows.Next() {
+		var version int
+		rows.Scan(&version)
+		applied = append(applied, version)
+	}
+	rows.Close()
+
+	if !reflect.DeepEqual(applied, expected) {
+		t.Errorf("Expected: %v\nActual: %v", expected, applied)
+	}
+}
+
+// Instances starting together against PostgreSQL wait for each other's
+// migrations rather than fail
+func TestSQLConcurrentMigrations(t *testing.T) {
+	driver, source := sqlTestSource(t)
+	if driver != "postgres" {
+		t.Skip("SQL_TEST_STORE does not name a PostgreSQL database")
+	}
+	store := openTestSQLStore(t, driver, source, &MockClock{current: MockNow})
+	for _, table := range []string{"schema_migrations", "links", "hits", "breakdowns", "visitors", "daily_visitors", "locks"} {
+		if _, err := store.db.Exec("DROP TABLE " + table); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	store.Close()
+
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			store, err := OpenSQLStore(driver, source, &MockClock{current: MockNow})
+			if err == nil {
+				store.Close()
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	}
+}
+
+func TestSQLCompactHits(t *testing.T) {
+	clock := &MockClock{current: MockNow}
+	driver, source := sqlTestSource(t)
+	store := openTestSQLStore(t, driver, source, clock)
+	defer store.Close()
+	store.SaveAlias("baz", "boo.baz", time.Time{})
+	store.RecordHits([]Hit{
+		{Code: "baz", Visit: Visit{Visitor: "alice"}, Time: MockNow},
+		{Code: "baz", Visit: Visit{Visitor: "bob"}, Time: MockNow.AddDate(0, 0, 1)},
+		{Code: "baz", Visit: Visit{Visitor: "slack", Bot: "Slackbot"}, Time: MockNow},
+	})
+
+	// Days past retention end up in their month, bots included
+	clock.current = MockNow.AddDate(0, 0, 3)
+	if compacted, err := store.CompactHits(RetentionPolicy{Days: 48 * time.Hour}); err != nil || compacted != 1 {
+		t.Errorf("Expected: %d\nActual: %d, %v", 1, compacted, err)
+	}
+
+	hits, _ := store.GetHits("baz")
+	month := time.Date(2016, time.June, 1, 0, 0, 0, 0, time.UTC)
+	expectedDays := map[time.Time]int{MockNow.AddDate(0, 0, 1): 1}
+	if !reflect.DeepEqual(hits.Days, expectedDays) || !reflect.DeepEqual(hits.Months, map[time.Time]int{month: 1}) {
+		t.Errorf("Expected days %v and a month of %d\nActual: %+v", expectedDays, 1, hits)
+	}
+	if hits.Count != 2 || hits.Bots != 1 || len(hits.BotDays) != 0 {
+		t.Errorf("Expected %d hits and %d bot hit\nActual: %+v", 2, 1, hits)
+	}
+}
+
+// A Referer longer than PostgreSQL indexes rows for must not fail the
+// batch, taking every other hit in it down too
+func TestSQLLongReferrer(t *testing.T) {
+	driver, source := sqlTestSource(t)
+	store := openTestSQLStore(t, driver, source, &MockClock{current: MockNow})
+	defer store.Close()
+	store.SaveAlias("baz", "boo.baz", time.Time{})
+
+	good := httptest.NewRequest("GET", "/baz", nil)
+	good.Header.Set("Referer", "https://reddit.com/r/golang")
+	bad := httptest.NewRequest("GET", "/baz", nil)
+	bad.Header.Set("Referer", "https://"+strings.Repeat("a", 40<<10)+".com/")
+	hits := []Hit{
+		{Code: "baz", Visit: newVisit(good, net.ParseIP("10.0.0.1")), Time: MockNow},
+		{Code: "baz", Visit: newVisit(bad, net.ParseIP("10.0.0.2")), Time: MockNow},
+	}
+	if err := store.RecordHits(hits); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	counts, _ := store.GetHits("baz")
+	referrers := make(map[string]int)
+	for _, tally := range counts.Referrers {
+		referrers[tally.Name] = tally.Hits
+	}
+	expected := map[string]int{"reddit.com": 1, "unknown": 1}
+	if counts.Count != 2 || !reflect.DeepEqual(referrers, expected) {
+		t.Errorf("Expected %d hits from %v\nActual: %+v", 2, expected, counts)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := `SELECT url FROM links WHERE code = ? AND expires_at > ?`
+	postgres := SQLStore{driver: "postgres"}
+	if expected := `SELECT url FROM links WHERE code = $1 AND expires_at > $2`; postgres.rebind(query) != expected {
+		t.Errorf("Expected: %s\nActual: %s", expected, postgres.rebind(query))
+	}
+	if sqlite := (SQLStore{driver: "sqlite"}); sqlite.rebind(query) != query {
+		t.Errorf("Expected: %s\nActual: %s", query, sqlite.rebind(query))
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// Hit series -- Hits.Days regrouped into contiguous, zero-filled buckets
+
+const defaultStatsWindow = 30 * 24 * time.Hour
+
+// Caps the response size for silly ranges such as ten years by day
+const maxStatsBuckets = 1000
+
+type Bucket struct {
+	Start time.Time
+	Hits  int
+}
+
+type HitSeries struct {
+	// Hits within the range, the sum of the buckets
+	Count       int
+	From        time.Time
+	To          time.Time
+	Granularity string
+	Buckets     []Bucket
+}
+
+var InvalidGranularity = errors.New("granularity must be one of hour, day, week or month")
+var TooManyBuckets = errors.New("Range too large for the requested granularity")
+
+// Start of the bucket holding t.  Weeks start on Monday.
+func bucketStart(t time.Time, granularity string) (time.Time, error) {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch granularity {
+	case "hour":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, time.UTC), nil
+	case "day":
+		return day, nil
+	case "week":
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset), nil
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC), nil
+	}
+
+	return time.Time{}, InvalidGranularity
+}
+
+func nextBucket(start time.Time, granularity string) time.Time {
+	switch granularity {
+	case "hour":
+		return start.Add(time.Hour)
+	case "week":
+		return start.AddDate(0, 0, 7)
+	case "month":
+		return start.AddDate(0, 1, 0)
+	}
+
+	return start.AddDate(0, 0, 1)
+}
+
+// Series groups the hits of h between the days from and to, both inclusive,
+// into buckets of the given granularity.  Buckets are contiguous, those
+// without hits are present with zero.  The first bucket may start before
+// from.  Hourly buckets only have data within the hour retention window, and
+// days rolled up into months only show up in monthly buckets.
+func (h Hits) Series(from, to time.Time, granularity string) (HitSeries, error) {
+	end := to.AddDate(0, 0, 1)
+	first, err := bucketStart(from, granularity)
+	if err != nil {
+		return HitSeries{}, err
+	}
+
+	last, _ := bucketStart(end.Add(-time.Hour), granularity)
+	series := HitSeries{From: from, To: to, Granularity: granularity, Buckets: []Bucket{}}
+	index := make(map[time.Time]int)
+	for start := first; !start.After(last); start = nextBucket(start, granularity) {
+		if len(series.Buckets) == maxStatsBuckets {
+			return HitSeries{}, TooManyBuckets
+		}
+
+		index[start] = len(series.Buckets)
+		series.Buckets = append(series.Buckets, Bucket{Start: start})
+	}
+
+	add := func(periods map[time.Time]int, since time.Time) {
+		for period, hits := range periods {
+			if period.Before(since) || !period.Before(end) {
+				continue
+			}
+
+			start, _ := bucketStart(period, granularity)
+			series.Buckets[index[start]].Hits += hits
+		}
+	}
+
+	switch granularity {
+	case "hour":
+		add(h.Hours, from)
+	case "month":
+		add(h.Days, from)
+		add(h.Months, first)
+	default:
+		add(h.Days, from)
+	}
+
+	for _, bucket := range series.Buckets {
+		series.Count += bucket.Hits
+	}
+	return series, nil
+}
+
+// Applies the retention policy every interval until done is closed, on
+// the ticks this instance claims the compaction lock
+func compactHitsPeriodically(store Datastore, policy RetentionPolicy, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		claimed, err := store.ClaimCompaction(interval)
+		if err != nil {
+			log.Printf("Could not claim hit compaction: %s", err.Error())
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		compacted, err := store.CompactHits(policy)
+		if err != nil {
+			log.Printf("Hit compaction failed after %d hashes: %s", compacted, err.Error())
+		}
+	}
+}
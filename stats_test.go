@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestBucketStart(t *testing.T) {
+	// 2016-06-16 is a Thursday
+	expectedMap := map[string]time.Time{
+		"hour":  time.Date(2016, time.June, 16, 13, 0, 0, 0, time.UTC),
+		"day":   date(2016, time.June, 16),
+		"week":  date(2016, time.June, 13),
+		"month": date(2016, time.June, 1),
+	}
+	for granularity, expected := range expectedMap {
+		actual, err := bucketStart(time.Date(2016, time.June, 16, 13, 45, 0, 0, time.UTC), granularity)
+		if err != nil || !actual.Equal(expected) {
+			t.Errorf("Granularity: %s\nExpected: %v\nActual: %v (%v)", granularity, expected, actual, err)
+		}
+	}
+
+	if _, err := bucketStart(MockNow, "fortnight"); err != InvalidGranularity {
+		t.Errorf("Expected: %v\nActual: %v", InvalidGranularity, err)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	hits := Hits{Count: 20, Days: map[time.Time]int{
+		date(2016, time.May, 30): 1,
+		date(2016, time.June, 1): 2,
+		date(2016, time.June, 2): 3,
+		date(2016, time.June, 9): 4,
+		date(2016, time.July, 1): 10,
+	}}
+
+	expectedMap := map[string][]Bucket{
+		"day": {
+			{date(2016, time.June, 1), 2}, {date(2016, time.June, 2), 3}, {date(2016, time.June, 3), 0},
+			{date(2016, time.June, 4), 0}, {date(2016, time.June, 5), 0}, {date(2016, time.June, 6), 0},
+			{date(2016, time.June, 7), 0}, {date(2016, time.June, 8), 0}, {date(2016, time.June, 9), 4},
+			{date(2016, time.June, 10), 0},
+		},
+		"week":  {{date(2016, time.May, 30), 5}, {date(2016, time.June, 6), 4}},
+		"month": {{date(2016, time.June, 1), 9}},
+	}
+	for granularity, expected := range expectedMap {
+		series, err := hits.Series(date(2016, time.June, 1), date(2016, time.June, 10), granularity)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+
+		// Only the hits in range count, not the 20 of all time
+		if series.Count != 9 || series.Granularity != granularity {
+			t.Errorf("Expected count %d and granularity %s, actual %d and %s", 9, granularity, series.Count, series.Granularity)
+		}
+
+		if !reflect.DeepEqual(series.Buckets, expected) {
+			t.Errorf("Granularity: %s\nExpected: %v\nActual: %v", granularity, expected, series.Buckets)
+		}
+	}
+
+	if _, err := hits.Series(date(2000, time.January, 1), date(2016, time.June, 10), "day"); err != TooManyBuckets {
+		t.Errorf("Expected: %v\nActual: %v", TooManyBuckets, err)
+	}
+}
+
+func TestSeriesHourly(t *testing.T) {
+	hits := Hits{Count: 9, Hours: map[time.Time]int{
+		time.Date(2016, time.June, 15, 23, 0, 0, 0, time.UTC): 1,
+		time.Date(2016, time.June, 16, 0, 0, 0, 0, time.UTC):  2,
+		time.Date(2016, time.June, 16, 23, 0, 0, 0, time.UTC): 3,
+		time.Date(2016, time.June, 17, 0, 0, 0, 0, time.UTC):  4,
+	}}
+
+	series, err := hits.Series(date(2016, time.June, 16), date(2016, time.June, 16), "hour")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if len(series.Buckets) != 24 {
+		t.Fatalf("Expected %d hourly buckets, actual %d", 24, len(series.Buckets))
+	}
+
+	if first, last := series.Buckets[0], series.Buckets[23]; first.Hits != 2 || last.Hits != 3 {
+		t.Errorf("Expected first and last buckets to hold %d and %d hits, actual %+v and %+v", 2, 3, first, last)
+	}
+}
+
+func TestSeriesRolledUpMonths(t *testing.T) {
+	hits := Hits{Count: 45,
+		Days:   map[time.Time]int{date(2016, time.May, 2): 5},
+		Months: map[time.Time]int{date(2016, time.March, 1): 30, date(2016, time.April, 1): 10},
+	}
+
+	series, err := hits.Series(date(2016, time.April, 15), date(2016, time.May, 31), "month")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expected := []Bucket{{date(2016, time.April, 1), 10}, {date(2016, time.May, 1), 5}}
+	if !reflect.DeepEqual(series.Buckets, expected) {
+		t.Errorf("Expected: %v\nActual: %v", expected, series.Buckets)
+	}
+
+	// Rolled up months cannot be split into days
+	series, _ = hits.Series(date(2016, time.April, 1), date(2016, time.April, 30), "day")
+	for _, bucket := range series.Buckets {
+		if bucket.Hits != 0 {
+			t.Errorf("Expected no daily hits in April, actual %+v", bucket)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocraft/web"
+)
+
+// With a certificate configured the server speaks HTTPS itself.  The
+// certificate and key are read again whenever either file changes, or on
+// SIGHUP, so renewed certificates are picked up without a restart; a pair
+// that fails to load is logged and the previous one kept.  An optional
+// plain HTTP listener redirects everything to HTTPS, and HTTPS responses
+// carry a Strict-Transport-Security header.
+
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.RWMutex // protects the fields below
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+// Fails if the pair cannot be loaded to begin with
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	return c, c.Reload()
+}
+
+// Reload reads the certificate and key, keeping the current pair if they
+// cannot be loaded
+func (c *CertReloader) Reload() error {
+	modTimes := c.fileModTimes()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.modTimes = modTimes
+	return nil
+}
+
+// For tls.Config.GetCertificate
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+func (c *CertReloader) fileModTimes() [2]time.Time {
+	var modTimes [2]time.Time
+	for i, file := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(file); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+func (c *CertReloader) changed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.fileModTimes() != c.modTimes
+}
+
+// Watch reloads the pair when either file has changed, checking every
+// interval, and whenever reload receives, until done is closed
+func (c *CertReloader) Watch(interval time.Duration, reload <-chan os.Signal, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-reload:
+		case <-ticker.C:
+			if !c.changed() {
+				continue
+			}
+		}
+
+		if err := c.Reload(); err != nil {
+			log.Printf("Could not reload certificate, keeping the current one: %s", err.Error())
+			continue
+		}
+		log.Printf("Reloaded certificate %s", c.certFile)
+	}
+}
+
+func (c *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.GetCertificate,
+	}
+}
+
+// Sends plain HTTP requests to the same host and path over HTTPS, on
+// httpsPort unless it is the default
+func redirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		// Only GET and HEAD may be turned into a GET by a 301
+		status := http.StatusMovedPermanently
+		if r.Method != "GET" && r.Method != "HEAD" {
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, target, status)
+	})
+}
+
+// Tells browsers to stick to HTTPS, on responses sent over it.  Subdomains
+// are only included when asked for, as the shortener's host may have
+// subdomains served over plain HTTP by others.
+func (s *Server) strictTransport(w web.ResponseWriter, r *web.Request, next web.NextMiddlewareFunc) {
+	if r.TLS != nil && s.HSTSMaxAge > 0 {
+		value := "max-age=" + strconv.Itoa(int(s.HSTSMaxAge.Seconds()))
+		if s.HSTSIncludeSubdomains {
+			value += "; includeSubDomains"
+		}
+		w.Header().Set("Strict-Transport-Security", value)
+	}
+	next(w, r)
+}
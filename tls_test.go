@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gocraft/web"
+)
+
+// Writes a self-signed certificate for 127.0.0.1 named commonName, returning
+// the parsed certificate
+func writeTestCert(t *testing.T, certFile string, keyFile string, commonName string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func testCertFiles(t *testing.T) (string, string, func()) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), func() { os.RemoveAll(dir) }
+}
+
+func servedName(c *CertReloader) string {
+	cert, _ := c.GetCertificate(nil)
+	parsed, _ := x509.ParseCertificate(cert.Certificate[0])
+	return parsed.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	certFile, keyFile, cleanup := testCertFiles(t)
+	defer cleanup()
+
+	if _, err := NewCertReloader(certFile, keyFile); err == nil {
+		t.Errorf("Expected an error for missing files")
+	}
+
+	writeTestCert(t, certFile, keyFile, "first")
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if name := servedName(reloader); name != "first" {
+		t.Errorf("Expected: %s\nActual: %s", "first", name)
+	}
+
+	writeTestCert(t, certFile, keyFile, "second")
+	if err := reloader.Reload(); err != nil || servedName(reloader) != "second" {
+		t.Errorf("Expected: %s\nActual: %s, %v", "second", servedName(reloader), err)
+	}
+
+	// A broken pair leaves the working one in place
+	ioutil.WriteFile(keyFile, []byte("not a key"), 0600)
+	if err := reloader.Reload(); err == nil || servedName(reloader) != "second" {
+		t.Errorf("Expected: %s with an error\nActual: %s, %v", "second", servedName(reloader), err)
+	}
+}
+
+func TestCertReloaderWatch(t *testing.T) {
+	certFile, keyFile, cleanup := testCertFiles(t)
+	defer cleanup()
+
+	writeTestCert(t, certFile, keyFile, "first")
+	reloader, _ := NewCertReloader(certFile, keyFile)
+	reload, done := make(chan os.Signal), make(chan struct{})
+	defer close(done)
+	go reloader.Watch(time.Millisecond, reload, done)
+
+	waitFor := func(expected string) {
+		for i := 0; i < 1000 && servedName(reloader) != expected; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if name := servedName(reloader); name != expected {
+			t.Errorf("Expected: %s\nActual: %s", expected, name)
+		}
+	}
+
+	// Changed files are noticed on their own
+	writeTestCert(t, certFile, keyFile, "second")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	waitFor("second")
+
+	// A reload is forced by SIGHUP even when the times look the same
+	modTime := reloader.fileModTimes()
+	writeTestCert(t, certFile, keyFile, "third")
+	os.Chtimes(certFile, modTime[0], modTime[0])
+	os.Chtimes(keyFile, modTime[1], modTime[1])
+	time.Sleep(5 * time.Millisecond)
+	if name := servedName(reloader); name != "second" {
+		t.Errorf("Expected: %s\nActual: %s", "second", name)
+	}
+	reload <- os.Interrupt
+	waitFor("third")
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile, cleanup := testCertFiles(t)
+	defer cleanup()
+
+	cert := writeTestCert(t, certFile, keyFile, "shortener")
+	reloader, _ := NewCertReloader(certFile, keyFile)
+	server := NewMockServer()
+	server.HSTSMaxAge = 24 * time.Hour
+	router := web.New(server)
+	setupRoutes(router, server)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := newHTTPServer(DefaultConfig().Server, router)
+	go httpServer.Serve(tls.NewListener(listener, reloader.TLSConfig()))
+	defer httpServer.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	response, err := client.Get("https://" + listener.Addr().String() + "/healthcheck")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	response.Body.Close()
+
+	expected := "max-age=86400"
+	if actual := response.Header.Get("Strict-Transport-Security"); actual != expected {
+		t.Errorf("Expected: %s\nActual: %s", expected, actual)
+	}
+
+	// Never over plain HTTP, where it would be ignored anyway
+	rw, request := NewRequest("GET", "/healthcheck", "")
+	router.ServeHTTP(rw, request)
+	if actual := rw.Header().Get("Strict-Transport-Security"); actual != "" {
+		t.Errorf("Expected no header\nActual: %s", actual)
+	}
+
+	// Subdomains are only pinned when asked for
+	server.HSTSIncludeSubdomains = true
+	router = web.New(server)
+	setupRoutes(router, server)
+	rw, request = NewRequest("GET", "/healthcheck", "")
+	request.TLS = &tls.ConnectionState{}
+	router.ServeHTTP(rw, request)
+	expected = "max-age=86400; includeSubDomains"
+	if actual := rw.Header().Get("Strict-Transport-Security"); actual != expected {
+		t.Errorf("Expected: %s\nActual: %s", expected, actual)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		method, host, path, port string
+		status                   int
+		location                 string
+	}{
+		{"GET", "sho.rt", "/foobar?utm=1", "443", 301, "https://sho.rt/foobar?utm=1"},
+		{"GET", "sho.rt:8080", "/foobar", "8443", 301, "https://sho.rt:8443/foobar"},
+		{"HEAD", "[::1]:80", "/", "443", 301, "https://[::1]/"},
+		{"POST", "sho.rt", "/create", "443", 308, "https://sho.rt/create"},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, "http://"+test.host+test.path, nil)
+		rw := httptest.NewRecorder()
+		redirectToHTTPS(test.port).ServeHTTP(rw, request)
+		if rw.Code != test.status || rw.Header().Get("Location") != test.location {
+			t.Errorf("Request: %s %s%s\nExpected: %d %s\nActual: %d %s", test.method, test.host, test.path,
+				test.status, test.location, rw.Code, rw.Header().Get("Location"))
+		}
+	}
+}
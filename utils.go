@@ -1,7 +1,10 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"hash/crc32"
+	"strconv"
 	"time"
 )
 
@@ -29,6 +32,44 @@ func hashUrl(long_url string) (short_url string) {
 	return
 }
 
+// Short url for the nth attempt at storing long_url; attempt 0 is the plain
+// hash so existing links keep their codes
+func saltedHashUrl(long_url string, attempt int) string {
+	if attempt == 0 {
+		return hashUrl(long_url)
+	}
+
+	return hashUrl(long_url + "#" + strconv.Itoa(attempt))
+}
+
+// Aliases may not shadow the fixed routes registered in setupRoutes
+var reservedAliases = map[string]bool{"create": true, "stats": true, "healthcheck": true, "api": true, "metrics": true, "healthz": true, "readyz": true}
+
+const maxAliasLength = 64
+
+func validAlias(alias string) bool {
+	if alias == "" || len(alias) > maxAliasLength || reservedAliases[alias] {
+		return false
+	}
+
+	for _, c := range alias {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Identifies a visitor for unique counts by hashing their address and user
+// agent, so neither is stored as is
+func visitorFingerprint(ip string, userAgent string) string {
+	sum := sha256.Sum256([]byte(ip + "\n" + userAgent))
+	return hex.EncodeToString(sum[:16])
+}
+
 // Clock interface for easy testing
 
 type Clock interface {
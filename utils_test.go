@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"testing"
 	"time"
 )
@@ -42,3 +43,51 @@ func TestHashURL(t *testing.T) {
 		}
 	}
 }
+
+func TestSaltedHashURL(t *testing.T) {
+	if actual := saltedHashUrl("hello", 0); actual != hashUrl("hello") {
+		t.Errorf("Expected unsalted hash: %s\nActual: %s", hashUrl("hello"), actual)
+	}
+
+	seen := make(map[string]bool)
+	for attempt := 0; attempt < maxHashAttempts; attempt++ {
+		shortURL := saltedHashUrl("hello", attempt)
+		if seen[shortURL] {
+			t.Errorf("Attempt %d repeated short url %s", attempt, shortURL)
+		}
+		seen[shortURL] = true
+	}
+}
+
+func TestValidAlias(t *testing.T) {
+	expectedMap := map[string]bool{
+		"spring-sale": true, "Q3_promo": true, "x": true,
+		"": false, "create": false, "stats": false, "healthcheck": false, "metrics": false,
+		"has space": false, "slash/es": false, "ünïcode": false,
+		strings.Repeat("a", maxAliasLength+1): false,
+	}
+	for alias, expected := range expectedMap {
+		if actual := validAlias(alias); actual != expected {
+			t.Errorf("Input alias: %q\nExpected: %v\nActual: %v", alias, expected, actual)
+		}
+	}
+}
+
+func TestVisitorFingerprint(t *testing.T) {
+	alice := visitorFingerprint("10.0.0.1", "Firefox")
+	if again := visitorFingerprint("10.0.0.1", "Firefox"); again != alice {
+		t.Errorf("Fingerprint is not stable: %s != %s", again, alice)
+	}
+
+	if other := visitorFingerprint("10.0.0.1", "Chrome"); other == alice {
+		t.Errorf("Different user agents share fingerprint %s", alice)
+	}
+
+	if other := visitorFingerprint("10.0.0.2", "Firefox"); other == alice {
+		t.Errorf("Different addresses share fingerprint %s", alice)
+	}
+
+	if strings.Contains(alice, "10.0.0.1") {
+		t.Errorf("Fingerprint %s leaks the address", alice)
+	}
+}